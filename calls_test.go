@@ -0,0 +1,93 @@
+package ergonode
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// testDeferredServer doesn't reply on the calls. Their 'from' tuples are
+// passed to 'calls'
+type testDeferredServer struct {
+	testEchoServer
+	calls chan etf.Tuple
+}
+
+func (gs *testDeferredServer) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (int, *etf.Term, interface{}) {
+	gs.calls <- *from
+	return 0, nil, state
+}
+
+func TestStaleCallReply(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := newTestInfoServer(false)
+	node1.Spawn(gs1)
+	gs2 := &testDeferredServer{calls: make(chan etf.Tuple, 1)}
+	pid2 := node2.Spawn(gs2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	message := etf.Term(etf.Atom("hello"))
+	if _, err := gs1.CallContext(ctx, pid2, &message); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// reply arrived after the timeout goes to HandleInfo
+	from := <-gs2.calls
+	gs2.Reply(from, etf.Atom("late"))
+	reply := etf.Tuple{from[1], etf.Atom("late")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, reply) {
+		t.Fatalf("expected %#v, got %#v", reply, message)
+	}
+
+	// nothing else (e.g. DOWN of the monitor made by the call) follows it
+	gs2.Stop(etf.Atom("normal"))
+	select {
+	case message := <-gs1.info:
+		t.Fatalf("unexpected message %#v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMalformedCall(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	gs2 := newTestInfoServer(false)
+	pid2 := node2.Spawn(gs2)
+
+	// sent by the peer, so they pass through the encoding
+	malformed := []etf.Term{
+		etf.Tuple{},
+		etf.Tuple{etf.Atom("$gen_call")},
+		etf.Tuple{etf.Atom("$gen_call"), etf.Atom("from"), etf.Atom("request")},
+		etf.Tuple{etf.Atom("$gen_call"), etf.Tuple{1, 2}, etf.Atom("request")},
+		etf.Tuple{etf.Atom("$gen_call"), etf.Tuple{gs1.Self, etf.Atom("tag")}},
+		etf.Tuple{etf.Atom("$gen_cast")},
+	}
+	for _, message := range malformed {
+		gs1.Send(pid2, &message)
+		if info := gs2.waitInfo(t); !reflect.DeepEqual(info, message) {
+			t.Fatalf("expected %#v, got %#v", message, info)
+		}
+	}
+
+	// the server is still alive
+	message := etf.Term(etf.Atom("hello"))
+	reply, err := gs1.Call(pid2, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reply != message {
+		t.Fatalf("expected %#v, got %#v", message, *reply)
+	}
+}
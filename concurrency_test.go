@@ -0,0 +1,70 @@
+package ergonode
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// TestConcurrentAccess spawns, registers, monitors, links and stops the
+// processes of two connected nodes concurrently while they exchange messages.
+// Makes sense with -race
+func TestConcurrentAccess(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	const workers = 10
+	const rounds = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		for _, nodes := range [][2]*Node{{node1, node2}, {node2, node1}} {
+			wg.Add(1)
+			go func(i int, local, remote *Node) {
+				defer wg.Done()
+				gs := new(testEchoServer)
+				local.Spawn(gs)
+				for j := 0; j < rounds; j++ {
+					name := etf.Atom(fmt.Sprintf("echo_%d_%d", i, j))
+					echo := new(testEchoServer)
+					pid := remote.Spawn(echo)
+					remote.Register(name, pid)
+					remote.Registered()
+
+					ref := local.Monitor(gs.Self, pid)
+					local.Link(gs.Self, pid)
+					local.Nodes()
+
+					message := etf.Term(j)
+					to := etf.Tuple{name, etf.Atom(remote.FullName)}
+					reply, err := gs.Call(to, &message)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if *reply != message {
+						errs <- fmt.Errorf("expected %v, got %v", message, *reply)
+						return
+					}
+					if err := local.Send(gs.Self, pid, &message); err != nil {
+						errs <- err
+						return
+					}
+
+					local.Unlink(gs.Self, pid)
+					local.Demonitor(ref)
+					remote.Unregister(name)
+					echo.Stop(etf.Atom("normal"))
+				}
+			}(i, nodes[0], nodes[1])
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
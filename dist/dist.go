@@ -30,7 +30,7 @@ func dLog(f string, a ...interface{}) {
 	}
 }
 
-type flagId uint32
+type flagId uint64
 
 const (
 	PUBLISHED           flagId = 0x1
@@ -51,8 +51,36 @@ const (
 	UTF8_ATOMS                 = 0x10000
 	MAP_TAG                    = 0x20000
 	BIG_CREATION               = 0x40000
+	SEND_SENDER                = 0x80000
+	BIG_SEQTRACE_LABELS        = 0x100000
+	EXIT_PAYLOAD               = 0x400000
+	FRAGMENTS                  = 0x800000
+	HANDSHAKE_23               = 0x1000000
+	UNLINK_ID                  = 0x2000000
+	MANDATORY_25_DIGEST        = 0x4000000
+	SPAWN                      = 0x100000000
+	NAME_ME                    = 0x200000000
+	V4_NC                      = 0x400000000
+	ALIAS                      = 0x800000000
 )
 
+// DefaultFlags is the set of distribution flags used by default. It contains
+// the flags mandatory for OTP 25+ (and OTP 26+: V4_NC and UNLINK_ID)
+const DefaultFlags = uint64(PUBLISHED | UNICODE_IO | DIST_MONITOR | DIST_MONITOR_NAME |
+	EXTENDED_PIDS_PORTS | EXTENDED_REFERENCES |
+	DIST_HDR_ATOM_CACHE | HIDDEN_ATOM_CACHE | NEW_FUN_TAGS |
+	SMALL_ATOM_TAGS | UTF8_ATOMS | MAP_TAG | BIG_CREATION |
+	FUN_TAGS | EXPORT_PTR_TAG | BIT_BINARIES | NEW_FLOATS |
+	HANDSHAKE_23 | UNLINK_ID | V4_NC | FRAGMENTS)
+
+// DefaultFragmentSize is the default maximum size of the fragment of the
+// message (FRAGMENTS)
+const DefaultFragmentSize = 65536
+
+// DefaultMaxMessageSize is the default limit of the size of the incoming
+// message (the frame or the reassembled fragments)
+const DefaultMaxMessageSize = 128 * 1024 * 1024
+
 type nodeFlag flagId
 
 func (nf nodeFlag) toUint32() (flag uint32) {
@@ -61,19 +89,51 @@ func (nf nodeFlag) toUint32() (flag uint32) {
 }
 
 func (nf nodeFlag) isSet(f flagId) (is bool) {
-	is = (uint32(nf) & uint32(f)) != 0
+	is = (uint64(nf) & uint64(f)) != 0
 	return
 }
 
 func toNodeFlag(f ...flagId) (nf nodeFlag) {
-	var flags uint32
+	var flags uint64
 	for _, v := range f {
-		flags |= uint32(v)
+		flags |= uint64(v)
 	}
 	nf = nodeFlag(flags)
 	return
 }
 
+// Statuses of the handshake sent by the accepting node
+const (
+	// StatusOk means the handshake will continue
+	StatusOk = "ok"
+	// StatusOkSimultaneous means the handshake will continue, but the
+	// accepting node shuts down its own attempt to connect to the initiator
+	StatusOkSimultaneous = "ok_simultaneous"
+	// StatusNok means the accepting node continues its own attempt to
+	// connect to the initiator (simultaneous connect)
+	StatusNok = "nok"
+	// StatusNotAllowed means the connection is disallowed
+	StatusNotAllowed = "not_allowed"
+	// StatusAlive means the accepting node already has a connection to the
+	// initiator. Initiator replies whether the handshake should continue
+	StatusAlive = "alive"
+)
+
+var (
+	// ErrStatusNok is returned if the remote node has rejected the
+	// handshake in favour of its own connection attempt
+	ErrStatusNok = errors.New("handshake is rejected (nok): simultaneous connect")
+	// ErrStatusNotAllowed is returned if the connection is disallowed
+	ErrStatusNotAllowed = errors.New("handshake is rejected (not_allowed)")
+	// ErrStatusAlive is returned if the node is already connected and the
+	// existing connection is kept
+	ErrStatusAlive = errors.New("handshake is rejected (alive): node is already connected")
+)
+
+// mandatoryFlags are required from the remote node. Connection is not
+// allowed without them
+const mandatoryFlags = uint64(EXTENDED_REFERENCES | EXTENDED_PIDS_PORTS)
+
 type nodeState uint8
 
 const (
@@ -85,6 +145,7 @@ type NodeDesc struct {
 	Name       string
 	Cookie     string
 	Hidden     bool
+	Creation   uint32
 	remote     *NodeDesc
 	state      nodeState
 	challenge  uint32
@@ -92,25 +153,106 @@ type NodeDesc struct {
 	version    uint16
 	term       *etf.Context
 	isacceptor bool
+	waitAlive  bool // 'alive' status is sent. Waiting for the reply
+	status     func(name string) string
+	pending    func() bool
+	cookie     func(name string) string
+
+	fragmentSize   int
+	maxMessageSize int
+	sequenceID     uint64                   // of the last fragmented message sent
+	fragments      map[uint64]*distFragment // messages being reassembled
 
 	Ready chan bool
 }
 
-func NewNodeDesc(name, cookie string, isHidden bool, c net.Conn) (nd *NodeDesc) {
+// distFragment is the fragmented message being reassembled
+type distFragment struct {
+	refs etf.DistRefs // atoms referenced by the header of the first fragment
+	next uint64       // id of the next fragment
+	data []byte
+}
+
+// NodeDescOptions defines the options of the connection
+type NodeDescOptions struct {
+	// Hidden node doesn't set PUBLISHED flag (like erl -hidden)
+	Hidden bool
+	// Flags is the set of distribution flags. DefaultFlags are used if it's 0
+	Flags uint64
+	// Creation of the node. It's sent to the remote node by the version 6
+	// handshake
+	Creation uint32
+	// Version of the handshake started by this node. Version 5 ('n'
+	// send_name) is upgraded to version 6 if both nodes support
+	// HANDSHAKE_23. Version 6 ('N' send_name) requires OTP 23+ on the
+	// remote side. Default is 5
+	Version uint16
+	// Status returns the status of the handshake with the node 'name' which
+	// has connected to this node (see Status* constants). StatusOk is used
+	// if it's nil
+	Status func(name string) string
+	// Pending reports whether the outgoing connection is still needed: this
+	// node hasn't been connected to the remote one by other means. It's
+	// asked once the remote node replies with StatusAlive. The remote
+	// connection is replaced only if it's pending, otherwise the handshake
+	// fails with ErrStatusAlive. Connection is always pending if it's nil
+	Pending func() bool
+	// Cookie returns the cookie used for the connection to the node 'name'.
+	// The cookie given to NewNodeDesc is used if it's nil
+	Cookie func(name string) string
+	// FragmentSize is the maximum size of the fragment. Bigger messages are
+	// split into fragments if both nodes support FRAGMENTS. Default is
+	// DefaultFragmentSize
+	FragmentSize int
+	// MaxMessageSize is the limit of the size of the incoming message. The
+	// connection is closed if the node sends the bigger one. Default is
+	// DefaultMaxMessageSize
+	MaxMessageSize int
+}
+
+// NewNodeDesc makes descriptor of the connection. Negotiation is started if
+// the connection is given (outgoing one)
+func NewNodeDesc(name, cookie string, opts NodeDescOptions, c net.Conn) (nd *NodeDesc) {
+	flags := opts.Flags
+	if flags == 0 {
+		flags = DefaultFlags
+	}
+	if opts.Hidden {
+		flags &^= uint64(PUBLISHED)
+	} else {
+		flags |= uint64(PUBLISHED)
+	}
+	version := opts.Version
+	if version != 6 {
+		version = 5
+	}
+	fragmentSize := opts.FragmentSize
+	if fragmentSize <= 0 {
+		fragmentSize = DefaultFragmentSize
+	}
+	maxMessageSize := opts.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
 	nd = &NodeDesc{
-		Name:   name,
-		Cookie: cookie,
-		Hidden: isHidden,
-		remote: nil,
-		state:  HANDSHAKE,
-		flag: toNodeFlag(PUBLISHED, UNICODE_IO, DIST_MONITOR,
-			EXTENDED_PIDS_PORTS, EXTENDED_REFERENCES,
-			DIST_HDR_ATOM_CACHE, HIDDEN_ATOM_CACHE, NEW_FUN_TAGS,
-			SMALL_ATOM_TAGS, UTF8_ATOMS, MAP_TAG, BIG_CREATION),
-		version:    5,
+		Name:       name,
+		Cookie:     cookie,
+		Hidden:     opts.Hidden,
+		Creation:   opts.Creation,
+		remote:     nil,
+		state:      HANDSHAKE,
+		flag:       nodeFlag(flags),
+		version:    version,
 		term:       new(etf.Context),
 		isacceptor: true,
-		Ready:      make(chan bool),
+		status:     opts.Status,
+		pending:    opts.Pending,
+		cookie:     opts.Cookie,
+		Ready:      make(chan bool, 1),
+
+		fragmentSize:   fragmentSize,
+		maxMessageSize: maxMessageSize,
+		fragments:      make(map[uint64]*distFragment),
 	}
 
 	nd.term.ConvertBinaryToString = true
@@ -118,7 +260,12 @@ func NewNodeDesc(name, cookie string, isHidden bool, c net.Conn) (nd *NodeDesc)
 	// new connection. negotiate
 	if c != nil {
 		nd.isacceptor = false
-		sn := nd.compose_SEND_NAME()
+		var sn []byte
+		if nd.version == 6 {
+			sn = nd.compose_SEND_NAME_6()
+		} else {
+			sn = nd.compose_SEND_NAME()
+		}
 		negmessage := make([]byte, len(sn)+2)
 		binary.BigEndian.PutUint16(negmessage[0:2], uint16(len(sn)))
 		copy(negmessage[2:], sn)
@@ -148,6 +295,10 @@ func (currNd *NodeDesc) ReadMessage(c net.Conn) (ts []etf.Term, err error) {
 		if err = binary.Read(c, binary.BigEndian, &length); err != nil {
 			return
 		}
+		if length == 0 {
+			err = errors.New("malformed handshake: empty message")
+			return
+		}
 		msg := make([]byte, length)
 		if _, err = io.ReadFull(c, msg); err != nil {
 			return
@@ -155,22 +306,39 @@ func (currNd *NodeDesc) ReadMessage(c net.Conn) (ts []etf.Term, err error) {
 		dLog("Read from enode %d: %v", length, msg)
 
 		switch msg[0] {
-		case 'n':
+		case 'n', 'N':
 			rand.Seed(time.Now().UTC().UnixNano())
 			currNd.challenge = rand.Uint32()
 
 			if currNd.isacceptor {
-				sn := currNd.read_SEND_NAME(msg)
-				// Statuses: ok, nok, ok_simultaneous, alive, not_allowed
-				sok := currNd.compose_SEND_STATUS(sn, true)
-				_, err = sendData(2, sok)
+				var sn *NodeDesc
+				if msg[0] == 'n' {
+					sn, err = currNd.read_SEND_NAME(msg)
+				} else {
+					sn, err = currNd.read_SEND_NAME_6(msg)
+				}
 				if err != nil {
 					return
 				}
+				status := currNd.handshakeStatus(sn)
+				if _, err = sendData(2, currNd.compose_SEND_STATUS(status)); err != nil {
+					return
+				}
+				switch status {
+				case StatusNok:
+					err = ErrStatusNok
+					return
+				case StatusNotAllowed:
+					err = ErrStatusNotAllowed
+					return
+				case StatusAlive:
+					// challenge is sent once the initiator confirms
+					// the handshake
+					currNd.waitAlive = true
+					return
+				}
 
-				// Now send challenge
-				challenge := currNd.compose_SEND_CHALLENGE(sn)
-				sendData(2, challenge)
+				_, err = sendData(2, currNd.compose_challenge(sn))
 				if err != nil {
 					return
 				}
@@ -178,75 +346,124 @@ func (currNd *NodeDesc) ReadMessage(c net.Conn) (ts []etf.Term, err error) {
 				//
 				dLog("Doing CHALLENGE (outgoing connection)")
 
-				challenge := currNd.read_SEND_CHALLENGE(msg)
+				var challenge uint32
+				if msg[0] == 'n' {
+					challenge, err = currNd.read_SEND_CHALLENGE(msg)
+				} else {
+					challenge, err = currNd.read_SEND_CHALLENGE_6(msg)
+				}
+				if err != nil {
+					return
+				}
+				if msg[0] == 'N' && currNd.version == 5 {
+					// remote node has upgraded the handshake to version 6.
+					// send the rest of our flags and creation
+					if _, err = sendData(2, currNd.compose_SEND_COMPLEMENT()); err != nil {
+						return
+					}
+				}
 				challenge_reply := currNd.compose_SEND_CHALENGE_REPLY(challenge)
 				sendData(2, challenge_reply)
 				return
 
 			}
 
+		case 'c':
+			if err = currNd.read_SEND_COMPLEMENT(msg); err != nil {
+				return
+			}
+
 		case 'r':
 			sn := currNd.remote
+			if sn == nil || currNd.waitAlive {
+				err = errors.New("unexpected challenge reply")
+				return
+			}
 			ok := currNd.read_SEND_CHALLENGE_REPLY(sn, msg)
 			if ok {
 				challengeAck := currNd.compose_SEND_CHALLENGE_ACK(sn)
-				sendData(2, challengeAck)
-				if err != nil {
+				if _, err = sendData(2, challengeAck); err != nil {
 					return
 				}
 				dLog("Remote: %#v", sn)
-				ts = []etf.Term{etf.Term(etf.Tuple{etf.Atom("$connection"), etf.Atom(sn.Name), currNd.Ready})}
+				ts = []etf.Term{etf.Term(etf.Tuple{etf.Atom("$connection"), etf.Atom(sn.Name), currNd.Ready, currNd.IsHiddenConn(), uint64(sn.flag)})}
 			} else {
 				err = errors.New("bad handshake")
 				return
 			}
 		case 's':
-			r := string(msg[1:len(msg)])
-			if r != "ok" {
-				c.Close()
-				dLog("Can't continue (recv_status: %s). Closing connection", r)
-				panic("recv_status is not ok. Closing connection")
+			r := string(msg[1:])
+			if currNd.isacceptor {
+				// reply to the 'alive' status
+				if !currNd.waitAlive || currNd.remote == nil {
+					err = fmt.Errorf("unexpected handshake status message: %q", r)
+					return
+				}
+				currNd.waitAlive = false
+				if r != "true" {
+					err = ErrStatusAlive
+					return
+				}
+				_, err = sendData(2, currNd.compose_challenge(currNd.remote))
+				return
 			}
 
+			dLog("Handshake status: %s", r)
+			switch r {
+			case StatusOk, StatusOkSimultaneous:
+			case StatusNok:
+				err = ErrStatusNok
+			case StatusNotAllowed:
+				err = ErrStatusNotAllowed
+			case StatusAlive:
+				// the existing connection on the remote side is stale
+				// unless the remote node has connected to this one
+				// in the meantime. Ask to replace the stale one only
+				if currNd.pending != nil && !currNd.pending() {
+					sendData(2, []byte("sfalse"))
+					err = ErrStatusAlive
+					break
+				}
+				_, err = sendData(2, []byte("strue"))
+			default:
+				err = fmt.Errorf("unknown handshake status: %q", r)
+			}
 			return
 
 		case 'a':
-			currNd.read_SEND_CHALLENGE_ACK(msg)
+			if !currNd.read_SEND_CHALLENGE_ACK(msg) {
+				err = errors.New("bad handshake")
+				return
+			}
 			sn := currNd.remote
 			dLog("Remote (outgoing): %#v", sn)
-			ts = []etf.Term{etf.Term(etf.Tuple{etf.Atom("$connection"), etf.Atom(sn.Name), currNd.Ready})}
+			ts = []etf.Term{etf.Term(etf.Tuple{etf.Atom("$connection"), etf.Atom(sn.Name), currNd.Ready, currNd.IsHiddenConn(), uint64(sn.flag)})}
 			return
 		}
 
 	case CONNECTED:
 		var length uint32
-		var err1 error
 		if err = binary.Read(c, binary.BigEndian, &length); err != nil {
 			return
 		}
 		if length == 0 {
-			dLog("Keepalive (%s)", currNd.remote.Name)
-			sendData(4, []byte{})
+			// tick. Both sides send ticks on their own (see WriteTick),
+			// so there is no need to answer it
+			dLog("Tick (%s)", currNd.remote.Name)
+			return
+		}
+		if uint64(length) > uint64(currNd.maxMessageSize) {
+			err = fmt.Errorf("message size %d exceeds the limit %d", length, currNd.maxMessageSize)
 			return
 		}
 		r := &io.LimitedReader{c, int64(length)}
 
-		if currNd.flag.isSet(DIST_HDR_ATOM_CACHE) {
-			var ctl, message etf.Term
-			if err = currNd.readDist(r); err != nil {
-				break
-			}
-			if ctl, err = currNd.readCtl(r); err != nil {
-				break
-			}
-			dLog("READ CTL: %#v", ctl)
-
-			if message, err1 = currNd.readMessage(r); err1 != nil {
-				// break
-
+		if currNd.distHeader() {
+			frame := make([]byte, length)
+			if _, err = io.ReadFull(r, frame); err != nil {
+				return
 			}
-			dLog("READ MESSAGE: %#v", message)
-			ts = append(ts, ctl, message)
+			ts, err = currNd.readDistFrame(frame)
 
 		} else {
 			msg := make([]byte, 1)
@@ -280,49 +497,240 @@ func (currNd *NodeDesc) ReadMessage(c net.Conn) (ts []etf.Term, err error) {
 	return
 }
 
-func (currNd *NodeDesc) WriteMessage(c net.Conn, ts []etf.Term) (err error) {
-	sendData := func(data []byte) (int, error) {
-		reply := make([]byte, len(data)+4)
-		binary.BigEndian.PutUint32(reply[0:4], uint32(len(data)))
-		copy(reply[4:], data)
-		dLog("Write to enode: %v", reply)
-		return c.Write(reply)
+// readDistFrame reads the message with the distribution header. Returns
+// nothing if it's not the last fragment of the message
+func (currNd *NodeDesc) readDistFrame(frame []byte) (ts []etf.Term, err error) {
+	if len(frame) < 2 || frame[0] != etf.EtVersion {
+		return nil, fmt.Errorf("Not dist header: %v", frame)
 	}
+	r := bytes.NewReader(frame[2:])
 
-	buf := new(bytes.Buffer)
-	if currNd.flag.isSet(DIST_HDR_ATOM_CACHE) {
-		buf.Write([]byte{etf.EtVersion})
-		currNd.term.WriteDist(buf, ts)
-		for _, v := range ts {
-			currNd.term.Write(buf, v)
+	if frame[1] == etf.EtDist {
+		var refs etf.DistRefs
+		if refs, err = currNd.term.ReadDistRefs(r); err != nil {
+			return
 		}
-	} else {
+		return currNd.readDistMessage(r, refs)
+	}
+
+	if frame[1] != etf.EtDistFragmentHeader && frame[1] != etf.EtDistFragment {
+		return nil, fmt.Errorf("Not dist header: %d", frame[1])
+	}
+	if len(frame) < 18 {
+		return nil, errors.New("malformed fragment")
+	}
+	sequenceID := binary.BigEndian.Uint64(frame[2:10])
+	fragmentID := binary.BigEndian.Uint64(frame[10:18])
+	r = bytes.NewReader(frame[18:])
+
+	if frame[1] == etf.EtDistFragmentHeader {
+		// the first fragment. Its header updates the atom cache right away,
+		// since the next messages may refer to the new entries
+		if _, exists := currNd.fragments[sequenceID]; exists {
+			return nil, fmt.Errorf("duplicate fragmented message %d", sequenceID)
+		}
+		var refs etf.DistRefs
+		if refs, err = currNd.term.ReadDistRefs(r); err != nil {
+			return
+		}
+		if fragmentID == 1 {
+			return currNd.readDistMessage(r, refs)
+		}
+		data := make([]byte, r.Len())
+		r.Read(data)
+		currNd.fragments[sequenceID] = &distFragment{
+			refs: refs,
+			next: fragmentID - 1,
+			data: data,
+		}
+		return
+	}
+
+	fragment, exists := currNd.fragments[sequenceID]
+	if !exists || fragment.next != fragmentID {
+		return nil, fmt.Errorf("unexpected fragment %d of the message %d", fragmentID, sequenceID)
+	}
+	if len(fragment.data)+len(frame)-18 > currNd.maxMessageSize {
+		return nil, fmt.Errorf("fragmented message %d exceeds the limit %d", sequenceID, currNd.maxMessageSize)
+	}
+	fragment.data = append(fragment.data, frame[18:]...)
+	if fragmentID > 1 {
+		fragment.next--
+		return
+	}
+	delete(currNd.fragments, sequenceID)
+	dLog("Reassembled message %d (%d bytes)", sequenceID, len(fragment.data))
+	return currNd.readDistMessage(bytes.NewReader(fragment.data), fragment.refs)
+}
+
+// readDistMessage reads the control message and the payload (if any)
+func (currNd *NodeDesc) readDistMessage(r *bytes.Reader, refs etf.DistRefs) (ts []etf.Term, err error) {
+	var ctl, message etf.Term
+	if ctl, err = currNd.term.ReadWithRefs(r, refs); err != nil {
+		return
+	}
+	dLog("READ CTL: %#v", ctl)
+
+	if r.Len() > 0 {
+		if message, err = currNd.term.ReadWithRefs(r, refs); err != nil {
+			// the whole frame has been read. Drop the message only
+			dLog("Can't decode message (ctl %#v): %s", ctl, err)
+			return nil, nil
+		}
+	}
+	dLog("READ MESSAGE: %#v", message)
+	ts = append(ts, ctl, message)
+	return
+}
+
+// WriteMessage sends the message. Fragments of the message (if it has been
+// split) are sent one by one
+func (currNd *NodeDesc) WriteMessage(c net.Conn, ts []etf.Term) (err error) {
+	frames, err := currNd.EncodeMessage(ts)
+	if err != nil {
+		// connection is fine. Drop the message only
+		dLog("Can't encode message %#v: %s", ts, err)
+		return nil
+	}
+	for _, frame := range frames {
+		dLog("Write to enode: %v", frame)
+		if _, err = c.Write(frame); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// EncodeMessage encodes the message and returns the frames (with the length
+// prefix) to be sent. Message is split into fragments if it's bigger than
+// the fragment size and both nodes support FRAGMENTS. Frames have to be sent
+// in order, but the other messages could be sent in between
+func (currNd *NodeDesc) EncodeMessage(ts []etf.Term) (frames [][]byte, err error) {
+	frame := func(size int) []byte {
+		b := make([]byte, 4, 4+size)
+		binary.BigEndian.PutUint32(b, uint32(size))
+		return b
+	}
+
+	if !currNd.distHeader() {
+		buf := new(bytes.Buffer)
 		buf.Write([]byte{'p'})
 		for _, v := range ts {
 			buf.Write([]byte{etf.EtVersion})
 			currNd.term.Write(buf, v)
 		}
+		f := append(frame(buf.Len()), buf.Bytes()...)
+		return [][]byte{f}, nil
+	}
+
+	header, payload, err := currNd.term.EncodeDist(ts)
+	if err != nil {
+		return
+	}
+
+	size := currNd.fragmentSize
+	if len(payload) <= size || !currNd.fragmentsEnabled() {
+		f := append(frame(1+len(header)+len(payload)), etf.EtVersion)
+		f = append(f, header...)
+		f = append(f, payload...)
+		return [][]byte{f}, nil
+	}
+
+	currNd.sequenceID++
+	n := (len(payload) + size - 1) / size
+	frames = make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		chunk := payload[i*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		// header of the first fragment is the dist header with 'E' tag
+		tag := etf.EtDistFragment
+		var distHeader []byte
+		if i == 0 {
+			tag = etf.EtDistFragmentHeader
+			distHeader = header[1:]
+		}
+		f := frame(18 + len(distHeader) + len(chunk))
+		f = append(f, etf.EtVersion, tag)
+		f = append(f, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(f[6:14], currNd.sequenceID)
+		binary.BigEndian.PutUint64(f[14:22], uint64(n-i))
+		f = append(f, distHeader...)
+		f = append(f, chunk...)
+		frames = append(frames, f)
 	}
-	// dLog("WRITE: %#v: %#v", ts, buf.Bytes())
-	_, err = sendData(buf.Bytes())
+	dLog("Message %d is split into %d fragments", currNd.sequenceID, n)
 	return
+}
+
+// fragmentsEnabled returns true if both nodes support FRAGMENTS
+func (currNd *NodeDesc) fragmentsEnabled() bool {
+	return currNd.flag.isSet(FRAGMENTS) &&
+		currNd.remote != nil && currNd.remote.flag.isSet(FRAGMENTS)
+}
 
+// distHeader returns true if the messages are sent with the distribution
+// header (both nodes support DIST_HDR_ATOM_CACHE)
+func (currNd *NodeDesc) distHeader() bool {
+	return currNd.flag.isSet(DIST_HDR_ATOM_CACHE) &&
+		currNd.remote != nil && currNd.remote.flag.isSet(DIST_HDR_ATOM_CACHE)
 }
 
 func (nd *NodeDesc) GetRemoteName() etf.Atom {
+	if nd.remote == nil {
+		// handshake hasn't been started
+		return etf.Atom("")
+	}
 	return etf.Atom(nd.remote.Name)
 }
 
+// IsConnected returns true once the handshake has been completed
+func (nd *NodeDesc) IsConnected() bool {
+	return nd.state == CONNECTED
+}
+
+// WriteTick writes the tick (zero length message) which keeps the connection
+// alive (like net_ticktime)
+func WriteTick(w io.Writer) error {
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// IsHiddenConn returns true if the connection is hidden: this node or the
+// remote one is hidden (hasn't set PUBLISHED flag)
+func (nd *NodeDesc) IsHiddenConn() bool {
+	if nd.Hidden {
+		return true
+	}
+	return nd.remote != nil && !nd.remote.flag.isSet(PUBLISHED)
+}
+
 func (nd *NodeDesc) compose_SEND_NAME() (msg []byte) {
 	msg = make([]byte, 7+len(nd.Name))
 	msg[0] = byte('n')
-	binary.BigEndian.PutUint16(msg[1:3], nd.version)
+	binary.BigEndian.PutUint16(msg[1:3], 5)
 	binary.BigEndian.PutUint32(msg[3:7], nd.flag.toUint32())
 	copy(msg[7:], nd.Name)
 	return
 }
 
-func (currNd *NodeDesc) read_SEND_NAME(msg []byte) (nd *NodeDesc) {
+// compose_SEND_NAME_6 makes 'N' send_name message (version 6)
+func (nd *NodeDesc) compose_SEND_NAME_6() (msg []byte) {
+	msg = make([]byte, 15+len(nd.Name))
+	msg[0] = byte('N')
+	binary.BigEndian.PutUint64(msg[1:9], uint64(nd.flag))
+	binary.BigEndian.PutUint32(msg[9:13], nd.Creation)
+	binary.BigEndian.PutUint16(msg[13:15], uint16(len(nd.Name)))
+	copy(msg[15:], nd.Name)
+	return
+}
+
+func (currNd *NodeDesc) read_SEND_NAME(msg []byte) (nd *NodeDesc, err error) {
+	if len(msg) < 7 {
+		return nil, errors.New("malformed send_name message")
+	}
 	version := binary.BigEndian.Uint16(msg[1:3])
 	flag := nodeFlag(binary.BigEndian.Uint32(msg[3:7]))
 	name := string(msg[7:])
@@ -335,38 +743,144 @@ func (currNd *NodeDesc) read_SEND_NAME(msg []byte) (nd *NodeDesc) {
 	return
 }
 
-func (currNd *NodeDesc) compose_SEND_STATUS(nd *NodeDesc, isOk bool) (msg []byte) {
-	msg = make([]byte, 3)
+// read_SEND_NAME_6 reads 'N' send_name message (version 6)
+func (currNd *NodeDesc) read_SEND_NAME_6(msg []byte) (nd *NodeDesc, err error) {
+	if len(msg) < 15 {
+		return nil, errors.New("malformed send_name message")
+	}
+	nameLen := int(binary.BigEndian.Uint16(msg[13:15]))
+	if len(msg) < 15+nameLen {
+		return nil, errors.New("malformed send_name message")
+	}
+	nd = &NodeDesc{
+		Name:     string(msg[15 : 15+nameLen]),
+		version:  6,
+		flag:     nodeFlag(binary.BigEndian.Uint64(msg[1:9])),
+		Creation: binary.BigEndian.Uint32(msg[9:13]),
+	}
+	currNd.remote = nd
+	return
+}
+
+// handshakeStatus returns the status of the handshake with the node which
+// has sent send_name message
+func (currNd *NodeDesc) handshakeStatus(nd *NodeDesc) string {
+	if uint64(nd.flag)&mandatoryFlags != mandatoryFlags || nd.Name == currNd.Name {
+		return StatusNotAllowed
+	}
+	if currNd.status == nil {
+		return StatusOk
+	}
+	return currNd.status(nd.Name)
+}
+
+func (currNd *NodeDesc) compose_SEND_STATUS(status string) (msg []byte) {
+	msg = make([]byte, 1+len(status))
 	msg[0] = byte('s')
-	copy(msg[1:], "ok")
+	copy(msg[1:], status)
 	return
 }
 
+// compose_challenge makes challenge message. Version 6 is used if the remote
+// node has started it or both nodes support it
+func (currNd *NodeDesc) compose_challenge(nd *NodeDesc) []byte {
+	if nd.version == 6 || (nd.flag.isSet(HANDSHAKE_23) && currNd.flag.isSet(HANDSHAKE_23)) {
+		return currNd.compose_SEND_CHALLENGE_6(nd)
+	}
+	return currNd.compose_SEND_CHALLENGE(nd)
+}
+
 func (currNd *NodeDesc) compose_SEND_CHALLENGE(nd *NodeDesc) (msg []byte) {
 	msg = make([]byte, 11+len(currNd.Name))
 	msg[0] = byte('n')
-	binary.BigEndian.PutUint16(msg[1:3], currNd.version)
+	binary.BigEndian.PutUint16(msg[1:3], 5)
 	binary.BigEndian.PutUint32(msg[3:7], currNd.flag.toUint32())
 	binary.BigEndian.PutUint32(msg[7:11], currNd.challenge)
 	copy(msg[11:], currNd.Name)
 	return
 }
 
-func (currNd *NodeDesc) read_SEND_CHALLENGE(msg []byte) (challenge uint32) {
+// compose_SEND_CHALLENGE_6 makes 'N' challenge message (version 6)
+func (currNd *NodeDesc) compose_SEND_CHALLENGE_6(nd *NodeDesc) (msg []byte) {
+	msg = make([]byte, 19+len(currNd.Name))
+	msg[0] = byte('N')
+	binary.BigEndian.PutUint64(msg[1:9], uint64(currNd.flag))
+	binary.BigEndian.PutUint32(msg[9:13], currNd.challenge)
+	binary.BigEndian.PutUint32(msg[13:17], currNd.Creation)
+	binary.BigEndian.PutUint16(msg[17:19], uint16(len(currNd.Name)))
+	copy(msg[19:], currNd.Name)
+	return
+}
+
+func (currNd *NodeDesc) read_SEND_CHALLENGE(msg []byte) (challenge uint32, err error) {
+	if len(msg) < 11 {
+		return 0, errors.New("malformed challenge message")
+	}
 	nd := &NodeDesc{
 		Name:    string(msg[11:]),
 		version: binary.BigEndian.Uint16(msg[1:3]),
 		flag:    nodeFlag(binary.BigEndian.Uint32(msg[3:7])),
 	}
 	currNd.remote = nd
-	return binary.BigEndian.Uint32(msg[7:11])
+	return binary.BigEndian.Uint32(msg[7:11]), nil
+}
+
+// read_SEND_CHALLENGE_6 reads 'N' challenge message (version 6)
+func (currNd *NodeDesc) read_SEND_CHALLENGE_6(msg []byte) (challenge uint32, err error) {
+	if len(msg) < 19 {
+		return 0, errors.New("malformed challenge message")
+	}
+	nameLen := int(binary.BigEndian.Uint16(msg[17:19]))
+	if len(msg) < 19+nameLen {
+		return 0, errors.New("malformed challenge message")
+	}
+	nd := &NodeDesc{
+		Name:     string(msg[19 : 19+nameLen]),
+		version:  6,
+		flag:     nodeFlag(binary.BigEndian.Uint64(msg[1:9])),
+		Creation: binary.BigEndian.Uint32(msg[13:17]),
+	}
+	currNd.remote = nd
+	return binary.BigEndian.Uint32(msg[9:13]), nil
+}
+
+// compose_SEND_COMPLEMENT makes 'c' message. It's sent by the node which
+// has started the handshake with 'n' send_name and received 'N' challenge
+func (currNd *NodeDesc) compose_SEND_COMPLEMENT() (msg []byte) {
+	msg = make([]byte, 9)
+	msg[0] = byte('c')
+	binary.BigEndian.PutUint32(msg[1:5], uint32(uint64(currNd.flag)>>32))
+	binary.BigEndian.PutUint32(msg[5:9], currNd.Creation)
+	return
+}
+
+func (currNd *NodeDesc) read_SEND_COMPLEMENT(msg []byte) error {
+	if len(msg) < 9 || currNd.remote == nil {
+		return errors.New("malformed complement message")
+	}
+	flagsHigh := uint64(binary.BigEndian.Uint32(msg[1:5]))
+	currNd.remote.flag = nodeFlag(uint64(currNd.remote.flag) | flagsHigh<<32)
+	currNd.remote.Creation = binary.BigEndian.Uint32(msg[5:9])
+	return nil
+}
+
+// cookieFor returns the cookie used for the connection to the node 'name'
+func (currNd *NodeDesc) cookieFor(name string) string {
+	if currNd.cookie == nil {
+		return currNd.Cookie
+	}
+	return currNd.cookie(name)
 }
 
 func (currNd *NodeDesc) read_SEND_CHALLENGE_REPLY(nd *NodeDesc, msg []byte) (isOk bool) {
+	if len(msg) < 21 {
+		dLog("BAD HANDSHAKE: malformed challenge reply")
+		return false
+	}
 	nd.challenge = binary.BigEndian.Uint32(msg[1:5])
-	digestB := msg[5:]
+	digestB := msg[5:21]
 
-	digestA := genDigest(currNd.challenge, currNd.Cookie)
+	digestA := genDigest(currNd.challenge, currNd.cookieFor(nd.Name))
 	if bytes.Compare(digestA, digestB) == 0 {
 		isOk = true
 		currNd.state = CONNECTED
@@ -381,7 +895,7 @@ func (currNd *NodeDesc) compose_SEND_CHALLENGE_ACK(nd *NodeDesc) (msg []byte) {
 	msg = make([]byte, 17)
 	msg[0] = byte('a')
 
-	digestB := genDigest(nd.challenge, currNd.Cookie) // FIXME: use his cookie, not mine
+	digestB := genDigest(nd.challenge, currNd.cookieFor(nd.Name))
 
 	copy(msg[1:], digestB)
 	return
@@ -392,14 +906,25 @@ func (currNd *NodeDesc) compose_SEND_CHALENGE_REPLY(challenge uint32) (msg []byt
 	msg[0] = byte('r')
 
 	binary.BigEndian.PutUint32(msg[1:5], currNd.challenge)
-	digest := genDigest(challenge, currNd.Cookie)
+	digest := genDigest(challenge, currNd.cookieFor(currNd.remote.Name))
 	copy(msg[5:], digest)
 	return
 }
 
-func (currNd *NodeDesc) read_SEND_CHALLENGE_ACK(msg []byte) {
+// read_SEND_CHALLENGE_ACK verifies the digest of our challenge sent by the
+// remote node
+func (currNd *NodeDesc) read_SEND_CHALLENGE_ACK(msg []byte) (isOk bool) {
+	if len(msg) < 17 || currNd.remote == nil {
+		dLog("BAD HANDSHAKE: malformed challenge ack")
+		return false
+	}
+	digestA := genDigest(currNd.challenge, currNd.cookieFor(currNd.remote.Name))
+	if bytes.Compare(digestA, msg[1:17]) != 0 {
+		dLog("BAD HANDSHAKE (ack): digestA: %+v, digestB: %+v", digestA, msg[1:17])
+		return false
+	}
 	currNd.state = CONNECTED
-	return
+	return true
 }
 
 func genDigest(challenge uint32, cookie string) (sum []byte) {
@@ -430,6 +955,17 @@ func (nd NodeDesc) Flags() (flags []string) {
 		UTF8_ATOMS:          "UTF8_ATOMS",
 		MAP_TAG:             "MAP_TAG",
 		BIG_CREATION:        "BIG_CREATION",
+		SEND_SENDER:         "SEND_SENDER",
+		BIG_SEQTRACE_LABELS: "BIG_SEQTRACE_LABELS",
+		EXIT_PAYLOAD:        "EXIT_PAYLOAD",
+		FRAGMENTS:           "FRAGMENTS",
+		HANDSHAKE_23:        "HANDSHAKE_23",
+		UNLINK_ID:           "UNLINK_ID",
+		MANDATORY_25_DIGEST: "MANDATORY_25_DIGEST",
+		SPAWN:               "SPAWN",
+		NAME_ME:             "NAME_ME",
+		V4_NC:               "V4_NC",
+		ALIAS:               "ALIAS",
 	}
 
 	for k, v := range fs {
@@ -454,27 +990,3 @@ func (currNd *NodeDesc) readTerm(r io.Reader) (t etf.Term, err error) {
 	t, err = currNd.term.Read(r)
 	return
 }
-
-func (currNd *NodeDesc) readDist(r io.Reader) (err error) {
-	b := make([]byte, 1)
-	_, err = io.ReadFull(r, b)
-
-	if err != nil {
-		return
-	}
-	if b[0] != etf.EtVersion {
-		err = fmt.Errorf("Not dist header: %d", b[0])
-		return
-	}
-	return currNd.term.ReadDist(r)
-}
-
-func (currNd *NodeDesc) readCtl(r io.Reader) (t etf.Term, err error) {
-	t, err = currNd.term.Read(r)
-	return
-}
-
-func (currNd *NodeDesc) readMessage(r io.Reader) (t etf.Term, err error) {
-	t, err = currNd.term.Read(r)
-	return
-}
@@ -1,10 +1,12 @@
 package dist
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/halturin/ergonode/lib"
 	"io"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -13,8 +15,9 @@ import (
 )
 
 const (
-	EPMD_ALIVE2_REQ  = 120
-	EPMD_ALIVE2_RESP = 121
+	EPMD_ALIVE2_REQ    = 120
+	EPMD_ALIVE2_RESP   = 121
+	EPMD_ALIVE2_X_RESP = 118 // 32-bit creation (distribution version 6)
 
 	EPMD_PORT_PLEASE2_REQ = 122
 	EPMD_PORT2_RESP       = 119
@@ -44,15 +47,24 @@ type EPMD struct {
 	HighVsn  uint16
 	LowVsn   uint16
 	Extra    []byte
-	Creation uint16
+	Creation uint32
 
 	response chan interface{}
+
+	mtx      sync.Mutex
+	conn     net.Conn // registration connection
+	stopped  bool
+	embedded bool // embedded EPMD server has been started by this node
 }
 
-func (e *EPMD) Init(name string, listenport uint16, epmdport uint16, hidden bool) {
+// Init registers the node on EPMD (host:port). Embedded EPMD server is
+// started (if it's enabled and the port isn't taken) before the registration.
+// Returns error if the node can't be registered. Node isn't registered if
+// listenport is 0
+func (e *EPMD) Init(name string, listenport uint16, epmdhost string, epmdport uint16, hidden bool, disableServer bool) error {
 	ns := strings.Split(name, "@")
-	if len(ns) != 2 {
-		panic("FQDN for node name is required (example: node@hostname)")
+	if len(ns) != 2 || ns[0] == "" || ns[1] == "" {
+		return fmt.Errorf("FQDN for node name is required (example: node@hostname)")
 	}
 
 	e.FullName = name
@@ -68,20 +80,79 @@ func (e *EPMD) Init(name string, listenport uint16, epmdport uint16, hidden bool
 	}
 
 	e.Protocol = 0
-	e.HighVsn = 5
+	e.HighVsn = 6
 	e.LowVsn = 5
 	e.Creation = 0
 
+	if listenport == 0 {
+		// node isn't reachable via EPMD (e.g. in-process transport)
+		e.stopped = true
+		return nil
+	}
+
+	// result of the first registration
+	registered := make(chan error, 1)
+
 	go func(e *EPMD) {
+		first := true
+		fail := func(err error) bool {
+			if !first {
+				return false
+			}
+			e.mtx.Lock()
+			e.stopped = true
+			embedded := e.embedded
+			e.mtx.Unlock()
+			if embedded {
+				StopServer(e.PortEMPD)
+			}
+			registered <- err
+			return true
+		}
+
 		for {
+			e.mtx.Lock()
+			stopped := e.stopped
+			e.mtx.Unlock()
+			if stopped {
+				return
+			}
+
 			// trying to start embedded EPMD before we go further
-			Server(epmdport)
+			embedded := false
+			if !disableServer {
+				embedded = Server(epmdport) == nil
+			}
 
-			dsn := net.JoinHostPort("", strconv.Itoa(int(epmdport)))
+			dsn := net.JoinHostPort(epmdhost, strconv.Itoa(int(epmdport)))
 			conn, err := net.Dial("tcp", dsn)
+
+			e.mtx.Lock()
+			if embedded {
+				e.embedded = true
+			}
+			if e.stopped {
+				e.mtx.Unlock()
+				if conn != nil {
+					conn.Close()
+				}
+				if embedded {
+					StopServer(e.PortEMPD)
+				}
+				return
+			}
+			e.conn = conn
+			e.mtx.Unlock()
+
 			if err != nil {
-				// we can't work without epmd service
-				panic(err.Error())
+				if fail(fmt.Errorf("Can't connect to EPMD: %s", err)) {
+					return
+				}
+				// EPMD server might have been just stopped. Try to
+				// start the embedded one
+				lib.Log("EPMD: can't connect (%s). Retrying", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
 			}
 
 			conn.Write(compose_ALIVE2_REQ(e))
@@ -92,39 +163,103 @@ func (e *EPMD) Init(name string, listenport uint16, epmdport uint16, hidden bool
 				if err != nil {
 					lib.Log("EPMD: closing connection")
 					conn.Close()
+					if fail(fmt.Errorf("EPMD has closed connection: %s", err)) {
+						return
+					}
 					break
 				}
 
-				if buf[0] == EPMD_ALIVE2_RESP {
+				if buf[0] == EPMD_ALIVE2_RESP || buf[0] == EPMD_ALIVE2_X_RESP {
 					creation := read_ALIVE2_RESP(buf)
 					switch creation {
 					case false:
-						panic(fmt.Sprintf("Duplicate name '%s'", e.Name))
+						conn.Close()
+						if fail(fmt.Errorf("Duplicate name '%s'", e.Name)) {
+							return
+						}
+						lib.Log("EPMD: name '%s' is taken. Retrying", e.Name)
+						time.Sleep(time.Second)
 					default:
-						e.Creation = creation.(uint16)
+						if first {
+							// keep the creation of the first registration on
+							// re-registering: pids and refs already made by
+							// the node have to stay valid
+							e.mtx.Lock()
+							e.Creation = creation.(uint32)
+							e.mtx.Unlock()
+							first = false
+							registered <- nil
+						}
+						continue
 					}
 				} else {
 					lib.Log("Malformed EPMD reply")
 					conn.Close()
-					break
+					if fail(fmt.Errorf("Malformed EPMD reply")) {
+						return
+					}
 				}
+				break
 			}
-
 		}
 	}(e)
 
+	return <-registered
+}
+
+// Close deregisters the node. Embedded EPMD server is stopped if it has been
+// started by this node (any other node in this process is able to start
+// it again)
+func (e *EPMD) Close() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.stopped {
+		return
+	}
+	e.stopped = true
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	if e.embedded {
+		StopServer(e.PortEMPD)
+		return
+	}
+	// do not wait for the embedded EPMD server (if it's running in this
+	// process) to notice the closed connection
+	leaveServer(e.PortEMPD, e.Name)
 }
 
 func (e *EPMD) ResolvePort(name string) (int, error) {
+	return e.ResolvePortContext(context.Background(), name)
+}
+
+// ResolvePortContext resolves port of the node like ResolvePort does.
+// Request is aborted once the context is done
+func (e *EPMD) ResolvePortContext(ctx context.Context, name string) (int, error) {
+	return ResolveNodePort(ctx, name, e.PortEMPD)
+}
+
+// ResolveNodePort requests port of the node 'name' from EPMD running on the
+// host of the node (epmdport). Request is aborted once the context is done
+func ResolveNodePort(ctx context.Context, name string, epmdport uint16) (int, error) {
 	ns := strings.Split(name, "@")
+	if len(ns) != 2 {
+		return -1, fmt.Errorf("wrong node name %q", name)
+	}
 
-	conn, err := net.Dial("tcp", net.JoinHostPort(ns[1], fmt.Sprintf("%d", e.PortEMPD)))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ns[1], fmt.Sprintf("%d", epmdport)))
 	if err != nil {
 		return -1, err
 	}
 
 	defer conn.Close()
 
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
 	buf := compose_PORT_PLEASE2_REQ(ns[0])
 	_, err = conn.Write(buf)
 	if err != nil {
@@ -166,10 +301,13 @@ func compose_ALIVE2_REQ(e *EPMD) (reply []byte) {
 }
 
 func read_ALIVE2_RESP(reply []byte) interface{} {
-	if reply[1] == 0 {
-		return binary.BigEndian.Uint16(reply[2:4])
+	if reply[1] != 0 {
+		return false
 	}
-	return false
+	if reply[0] == EPMD_ALIVE2_X_RESP {
+		return binary.BigEndian.Uint32(reply[2:6])
+	}
+	return uint32(binary.BigEndian.Uint16(reply[2:4]))
 }
 
 func compose_PORT_PLEASE2_REQ(name string) (reply []byte) {
@@ -192,8 +330,10 @@ type nodeinfo struct {
 }
 
 type epmdsrv struct {
-	portmap map[string]*nodeinfo
-	mtx     sync.RWMutex
+	portmap  map[string]*nodeinfo
+	mtx      sync.RWMutex
+	listener net.Listener
+	conns    map[net.Conn]bool
 }
 
 func (e *epmdsrv) Join(name string, info *nodeinfo) bool {
@@ -237,11 +377,45 @@ func (e *epmdsrv) ListAll() map[string]uint16 {
 	return lst
 }
 
-var epmdserver *epmdsrv
+func (e *epmdsrv) addConn(c net.Conn) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.conns == nil {
+		// server has been stopped
+		return false
+	}
+	e.conns[c] = true
+	return true
+}
+
+func (e *epmdsrv) removeConn(c net.Conn) {
+	e.mtx.Lock()
+	delete(e.conns, c)
+	e.mtx.Unlock()
+}
+
+func (e *epmdsrv) stop() {
+	e.listener.Close()
+
+	e.mtx.Lock()
+	for c := range e.conns {
+		c.Close()
+	}
+	e.conns = nil
+	e.mtx.Unlock()
+}
+
+var (
+	// embedded EPMD servers by port
+	epmdservers   = make(map[uint16]*epmdsrv)
+	epmdserverMtx sync.Mutex
+)
 
 func Server(port uint16) error {
+	epmdserverMtx.Lock()
+	defer epmdserverMtx.Unlock()
 
-	if epmdserver != nil {
+	if _, exists := epmdservers[port]; exists {
 		// already started
 		return fmt.Errorf("Already started")
 	}
@@ -253,9 +427,12 @@ func Server(port uint16) error {
 
 	}
 
-	epmdserver = &epmdsrv{
-		portmap: make(map[string]*nodeinfo),
+	srv := &epmdsrv{
+		portmap:  make(map[string]*nodeinfo),
+		listener: epmd,
+		conns:    make(map[net.Conn]bool),
 	}
+	epmdservers[port] = srv
 
 	lib.Log("Started embedded EMPD service and listen port: %d", port)
 
@@ -264,13 +441,22 @@ func Server(port uint16) error {
 			c, err := epmd.Accept()
 			if err != nil {
 				lib.Log(err.Error())
-				continue
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				// listener has been closed
+				return
 			}
 
 			lib.Log("EPMD accepted new connection from %s", c.RemoteAddr().String())
+			if !srv.addConn(c) {
+				c.Close()
+				return
+			}
 
 			//epmd connection handler loop
 			go func(c net.Conn) {
+				defer srv.removeConn(c)
 				defer c.Close()
 				buf := make([]byte, 1024)
 				name := ""
@@ -279,7 +465,7 @@ func Server(port uint16) error {
 					lib.Log("Request from EPMD client: %v", buf[:n])
 					if err != nil {
 						if name != "" {
-							epmdserver.Leave(name)
+							srv.Leave(name)
 						}
 						return
 					}
@@ -290,7 +476,7 @@ func Server(port uint16) error {
 
 					switch buf[2] {
 					case EPMD_ALIVE2_REQ:
-						reply, registered := compose_ALIVE2_RESP(buf[3:n])
+						reply, registered := compose_ALIVE2_RESP(srv, buf[3:n])
 						c.Write(reply)
 						if registered == "" {
 							return
@@ -303,10 +489,10 @@ func Server(port uint16) error {
 						}
 						continue
 					case EPMD_PORT_PLEASE2_REQ:
-						c.Write(compose_EPMD_PORT2_RESP(buf[3:n]))
+						c.Write(compose_EPMD_PORT2_RESP(srv, buf[3:n]))
 						return
 					case EPMD_NAMES_REQ:
-						c.Write(compose_EPMD_NAMES_RESP(port, buf[3:n]))
+						c.Write(compose_EPMD_NAMES_RESP(srv, port, buf[3:n]))
 						return
 					default:
 						lib.Log("unknown EPMD request")
@@ -322,7 +508,34 @@ func Server(port uint16) error {
 	return nil
 }
 
-func compose_ALIVE2_RESP(req []byte) ([]byte, string) {
+// StopServer stops embedded EPMD server listening the given port. All the
+// nodes registered on it get disconnected. Server could be started again
+// using Server
+func StopServer(port uint16) {
+	epmdserverMtx.Lock()
+	srv := epmdservers[port]
+	delete(epmdservers, port)
+	epmdserverMtx.Unlock()
+
+	if srv == nil {
+		return
+	}
+	lib.Log("Stopping embedded EPMD service")
+	srv.stop()
+}
+
+// leaveServer unregisters the node on embedded EPMD server (if it's running)
+func leaveServer(port uint16, name string) {
+	epmdserverMtx.Lock()
+	srv := epmdservers[port]
+	epmdserverMtx.Unlock()
+
+	if srv != nil {
+		srv.Leave(name)
+	}
+}
+
+func compose_ALIVE2_RESP(srv *epmdsrv, req []byte) ([]byte, string) {
 
 	hidden := false //
 	if req[2] == 72 {
@@ -339,25 +552,33 @@ func compose_ALIVE2_RESP(req []byte) ([]byte, string) {
 		LoVersion: binary.BigEndian.Uint16(req[6:8]),
 	}
 
-	reply := make([]byte, 4)
-	reply[0] = EPMD_ALIVE2_RESP
+	// nodes supporting distribution version 6 get 32-bit creation
+	var reply []byte
+	if info.HiVersion >= 6 {
+		reply = make([]byte, 6)
+		reply[0] = EPMD_ALIVE2_X_RESP
+		binary.BigEndian.PutUint32(reply[2:], rand.Uint32()%0xfffffff0+4)
+	} else {
+		reply = make([]byte, 4)
+		reply[0] = EPMD_ALIVE2_RESP
+		binary.BigEndian.PutUint16(reply[2:], uint16(1))
+	}
 
 	registered := ""
-	if epmdserver.Join(name, &info) {
+	if srv.Join(name, &info) {
 		reply[1] = 0
 		registered = name
 	} else {
 		reply[1] = 1
 	}
 
-	binary.BigEndian.PutUint16(reply[2:], uint16(1))
 	lib.Log("Made reply for ALIVE2_REQ: (%s) %#v", name, reply)
 	return reply, registered
 }
 
-func compose_EPMD_PORT2_RESP(req []byte) []byte {
+func compose_EPMD_PORT2_RESP(srv *epmdsrv, req []byte) []byte {
 	name := string(req)
-	info := epmdserver.Get(name)
+	info := srv.Get(name)
 
 	if info == nil {
 		// not found
@@ -389,14 +610,14 @@ func compose_EPMD_PORT2_RESP(req []byte) []byte {
 	return reply
 }
 
-func compose_EPMD_NAMES_RESP(port uint16, req []byte) []byte {
+func compose_EPMD_NAMES_RESP(srv *epmdsrv, port uint16, req []byte) []byte {
 	// io:format("name ~ts at port ~p~n", [NodeName, Port]).
 	var str strings.Builder
 	var s string
 	var portbuf [4]byte
 	binary.BigEndian.PutUint32(portbuf[0:4], uint32(port))
 	str.WriteString(string(portbuf[0:]))
-	for h, p := range epmdserver.ListAll() {
+	for h, p := range srv.ListAll() {
 		s = fmt.Sprintf("name %s at port %d\n", h, p)
 		str.WriteString(s)
 	}
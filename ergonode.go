@@ -6,6 +6,7 @@
 package ergonode
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/halturin/ergonode/dist"
@@ -13,62 +14,183 @@ import (
 	"github.com/halturin/ergonode/lib"
 
 	"net"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type regReq struct {
-	replyTo  chan etf.Pid
-	channels procChannels
+var (
+	// ErrNameTaken is returned by Register if the name is registered by
+	// another process
+	ErrNameTaken = errors.New("name is already registered")
+	// ErrProcessNamed is returned by Register if the process has been
+	// already registered with another name
+	ErrProcessNamed = errors.New("process already has a name")
+	// ErrNoProc is returned if the process doesn't exist
+	ErrNoProc = errors.New("noproc")
+	// ErrNotJoined is returned by Leave if the process isn't the member of
+	// the group
+	ErrNotJoined = errors.New("not_joined")
+)
+
+type nodeConn struct {
+	conn   net.Conn
+	wchan  chan []etf.Term
+	hidden bool
+	flags  uint64 // distribution flags of the remote node
 }
 
-type regNameReq struct {
-	name etf.Atom
-	pid  etf.Pid
+// outbox is the unbounded queue of the messages produced by the reader of the
+// connection (replies on LINK, MONITOR etc). The reader must never be
+// blocked by the writer, otherwise two nodes could deadlock each other once
+// both writers are waiting for the remote readers
+type outbox struct {
+	lock  sync.Mutex
+	queue [][]etf.Term
+	ready chan struct{} // has a value while the outbox isn't empty
 }
 
-type unregNameReq struct {
-	name etf.Atom
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
 }
 
-type registryChan struct {
-	storeChan     chan regReq
-	regNameChan   chan regNameReq
-	unregNameChan chan unregNameReq
+// push queues the message. Never blocks
+func (ob *outbox) push(terms []etf.Term) {
+	ob.lock.Lock()
+	ob.queue = append(ob.queue, terms)
+	ob.lock.Unlock()
+	select {
+	case ob.ready <- struct{}{}:
+	default:
+	}
 }
 
-type nodeConn struct {
-	conn  net.Conn
-	wchan chan []etf.Term
+// popAll takes all the queued messages
+func (ob *outbox) popAll() (queue [][]etf.Term) {
+	ob.lock.Lock()
+	queue, ob.queue = ob.queue, nil
+	ob.lock.Unlock()
+	return
+}
+
+// handshake is an outgoing connection attempt to the node which is in
+// progress. Concurrent connects to the same node wait for it
+type handshake struct {
+	conn      net.Conn      // connection being negotiated (nil while dialing)
+	aborted   bool          // aborted by the simultaneous incoming connection
+	connected chan struct{} // closed once a connection to the node is registered
+	done      chan struct{} // closed once the attempt is finished
+	err       error
 }
 
+// simultaneousTimeout is how long the node waits for the incoming connection
+// once its own attempt has been rejected in favour of it (like net_setuptime)
+const simultaneousTimeout = 7 * time.Second
+
+// setupTimeout limits the connection attempt (resolving, dialing and the
+// handshake). The attempt is shared by all the callers, so it isn't bound to
+// the context of any of them. It limits the handshake of the incoming
+// connections as well
+const setupTimeout = 7 * time.Second
+
+// defaultTickTime is the default value of NodeOptions.TickTime (seconds)
+const defaultTickTime = 60
+
+// tickTimeouts is the number of the tick intervals without any data received
+// after which the connected node is considered down
+const tickTimeouts = 4
+
+// exitChanSize is the number of exit signals buffered for the process
+const exitChanSize = 100
+
 type systemProcs struct {
 	netKernel        *netKernel
 	globalNameServer *globalNameServer
 	rpcRex           *rpcRex
+	pg               *pgScope
 }
 
 type Node struct {
 	dist.EPMD
 	epmdreply   chan interface{}
-	Cookie      string
-	registry    *registryChan
-	channels    map[etf.Pid]procChannels
-	registered  map[etf.Atom]etf.Pid
+	Cookie      string                   // default cookie. Use SetCookie to change it
+	cookies     map[etf.Atom]string      // cookies of the particular nodes
+	channels    map[etf.Pid]procChannels // guarded by procLock
+	registered  map[etf.Atom]etf.Pid     // guarded by procLock
 	connections map[etf.Atom]nodeConn
+	handshakes  map[etf.Atom]*handshake // outgoing connection attempts
 	sysProcs    systemProcs
-	monitors    map[etf.Atom][]etf.Pid // node monitors
-	monitorsP   map[etf.Pid][]etf.Pid  // process monitors
+	monitors    map[etf.Atom][]etf.Pid           // node monitors
+	monitorsA   []etf.Pid                        // monitors of all the visible nodes
+	monitorsP   map[etf.Pid][]monitorProcess     // process monitors (by target)
+	monitorsN   map[monitorName][]monitorProcess // remote process monitors by name
+	links       map[etf.Pid][]etf.Pid            // process links (both directions)
 	procID      uint32
-	lock        sync.Mutex
+	unlinkID    uint64          // id of the last UNLINK_ID request
+	refID       uint64          // id of the last reference made by MakeRef
+	context     context.Context // node-level context. Processes are tied to it
+	cancel      context.CancelFunc
+
+	// lock guards cookies, connections, handshakes, monitors and links.
+	// procLock guards the process table and the name registry. procLock
+	// could be taken while lock is held, but not vice versa
+	lock     sync.Mutex
+	procLock sync.RWMutex
+
+	listener    net.Listener
+	processes   sync.WaitGroup
+	conns       sync.WaitGroup // reader/writer goroutines of the connections
+	stopping    chan struct{}  // closed once Stop is called
+	closing     chan struct{}  // closed once all the processes have exited
+	stoppedOnce sync.Once
+	opts        NodeOptions
 }
 
 type procChannels struct {
-	in     chan etf.Term
-	inFrom chan etf.Tuple
-	init   chan bool
+	mailbox *mailbox
+	exit    chan procExit
+	init    chan bool
+
+	context context.Context // process context. It's cancelled once the process exits
+	cancel  context.CancelFunc
+}
+
+// sendExit delivers the exit signal to the process. It never blocks: the
+// sender might be the connection reader. Signals exceeding the channel
+// buffer are delivered asynchronously until the process exits
+func (pcs procChannels) sendExit(ex procExit) {
+	select {
+	case pcs.exit <- ex:
+		return
+	default:
+	}
+	go func() {
+		select {
+		case pcs.exit <- ex:
+		case <-pcs.context.Done():
+		}
+	}()
+}
+
+// monitorProcess describes the monitor set by 'process' with reference 'ref'.
+// Field 'name' is set if the monitor was created by registered name
+type monitorProcess struct {
+	process etf.Pid
+	ref     etf.Ref
+	name    etf.Atom
+}
+
+// monitorName is the {Name, Node} target of the monitor
+type monitorName struct {
+	name etf.Atom
+	node etf.Atom
+}
+
+// procExit is an exit signal sent to the process
+type procExit struct {
+	from   etf.Pid
+	reason etf.Term
+	kill   bool // untrappable 'kill' (sent via exit/2)
 }
 
 // Behaviour interface contains methods you should implement to make own process behaviour
@@ -83,94 +205,170 @@ type Process interface {
 	setPid(pid etf.Pid)                        // method set pid of started process
 }
 
+// NodeOptions defines the options of the node. Zero values mean defaults
+type NodeOptions struct {
+	// ListenRangeBegin...ListenRangeEnd is the range of ports to listen for
+	// incoming connections. Default is 15000...65000
+	ListenRangeBegin uint16
+	ListenRangeEnd   uint16
+	// EPMDHost and EPMDPort is the address of EPMD server the node is
+	// registered on. Default is localhost:4369
+	EPMDHost string
+	EPMDPort uint16
+	// DisableEPMDServer disables embedded EPMD server
+	DisableEPMDServer bool
+	// Hidden node isn't published to the other nodes
+	Hidden bool
+	// Creation of the node. Value from EPMD is used by default
+	Creation uint32
+	// DistFlags is the set of distribution flags. Default is dist.DefaultFlags
+	DistFlags uint64
+	// HandshakeVersion is the version of the handshake started by this node.
+	// Version 5 is upgraded to 6 if the remote node supports it (OTP 23+).
+	// Version 6 can't be used with the nodes older than OTP 23. Default is 5
+	HandshakeVersion int
+	// CallTimeout is the default timeout (in seconds) of GenServer.Call.
+	// Default is 5 seconds
+	CallTimeout int
+	// TLS enables TLS distribution (like -proto_dist inet_tls)
+	TLS *NodeTLSOptions
+	// Transport of the distribution connections. Default is TCPTransport
+	// (TLSTransport if TLS is set)
+	Transport Transport
+	// Cookies overrides the cookie for the particular nodes (like
+	// erlang:set_cookie/2). The default cookie is used for the rest
+	Cookies map[etf.Atom]string
+	// FragmentSize is the maximum size (in bytes) of the fragment of the
+	// outgoing message. Bigger messages are split into fragments, so the other
+	// messages are sent in between (OTP 22+). Default is
+	// dist.DefaultFragmentSize. Fragmentation is disabled if DistFlags
+	// doesn't contain dist.FRAGMENTS
+	FragmentSize int
+	// MaxMessageSize is the limit (in bytes) of the incoming message. The
+	// connection is closed if the node sends the bigger one. Default is
+	// dist.DefaultMaxMessageSize (128MB)
+	MaxMessageSize int
+	// TickTime (in seconds) is the time the connected node may keep silence
+	// before it's considered down (like net_ticktime). Ticks are sent every
+	// TickTime/4 seconds if there is nothing else to send. Default is 60
+	TickTime int
+}
+
 // Create create new node context with specified name and cookie string
-func Create(name string, cookie string, ports ...uint16) (node *Node) {
-	var listenRangeBegin uint16 = 15000
-	var listenRangeEnd uint16 = 65000
-	var hidden bool = false
-	var portEPMD uint16 = 4369
-	var listenPort uint16 = 0
-	var listener net.Listener
+func Create(name string, cookie string, opts NodeOptions) (*Node, error) {
+	return CreateWithContext(context.Background(), name, cookie, opts)
+}
 
+// CreateWithContext creates new node like Create does. All the processes of
+// the node are tied to the given context: they are stopped with reason
+// 'shutdown' once the context is done
+func CreateWithContext(ctx context.Context, name string, cookie string, opts NodeOptions) (*Node, error) {
 	lib.Log("Start with name '%s' and cookie '%s'", name, cookie)
 
-	switch len(ports) {
-	case 0:
-		// use defaults
-	case 1:
-		listenRangeBegin = ports[0]
-	case 2:
-		listenRangeBegin = ports[0]
-		listenRangeEnd = ports[1]
-		if listenRangeBegin-listenRangeEnd < 0 {
-			panic("Wrong port arguments")
-		}
-	case 3:
-		listenRangeBegin = ports[0]
-		listenRangeEnd = ports[1]
-		if listenRangeBegin-listenRangeEnd < 0 {
-			panic("Wrong port arguments")
-		}
-		portEPMD = ports[2]
-
-	default:
-		panic("Wrong port arguments")
+	if opts.ListenRangeBegin == 0 {
+		opts.ListenRangeBegin = 15000
 	}
-
-	lib.Log("Listening range: %d...%d", listenRangeBegin, listenRangeEnd)
-	if portEPMD != 4369 {
-		lib.Log("Using custom EPMD port: %d", portEPMD)
+	if opts.ListenRangeEnd == 0 {
+		opts.ListenRangeEnd = 65000
+	}
+	if opts.ListenRangeBegin > opts.ListenRangeEnd {
+		return nil, fmt.Errorf("Wrong listen port range: %d...%d", opts.ListenRangeBegin, opts.ListenRangeEnd)
+	}
+	if opts.EPMDPort == 0 {
+		opts.EPMDPort = 4369
+	}
+	if opts.DistFlags == 0 {
+		opts.DistFlags = dist.DefaultFlags
+	}
+	if opts.CallTimeout <= 0 {
+		opts.CallTimeout = 5
+	}
+	if opts.TickTime <= 0 {
+		opts.TickTime = defaultTickTime
 	}
 
-	for p := listenRangeBegin; p <= listenRangeEnd; p++ {
-		l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(p))))
+	if opts.TLS != nil {
+		if opts.Transport != nil {
+			return nil, errors.New("TLS and Transport options can't be used together")
+		}
+		t, err := NewTLSTransport(*opts.TLS)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		listenPort = p
-		listener = l
-		break
+		opts.Transport = t
+	}
+	if opts.Transport == nil {
+		opts.Transport = TCPTransport{}
 	}
 
-	if listenPort == 0 {
-		panic("Can't listen port")
+	lib.Log("Listening range: %d...%d", opts.ListenRangeBegin, opts.ListenRangeEnd)
+	if opts.EPMDPort != 4369 {
+		lib.Log("Using custom EPMD port: %d", opts.EPMDPort)
 	}
 
-	registry := &registryChan{
-		storeChan:     make(chan regReq),
-		regNameChan:   make(chan regNameReq),
-		unregNameChan: make(chan unregNameReq),
+	listener, listenPort, err := opts.Transport.Listen(ctx, name, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	epmd := dist.EPMD{}
-	epmd.Init(name, listenPort, portEPMD, hidden)
+	nodeCtx, cancel := context.WithCancel(ctx)
 
-	node = &Node{
-		EPMD:        epmd,
+	node := &Node{
 		Cookie:      cookie,
-		registry:    registry,
+		cookies:     make(map[etf.Atom]string),
 		channels:    make(map[etf.Pid]procChannels),
 		registered:  make(map[etf.Atom]etf.Pid),
 		connections: make(map[etf.Atom]nodeConn),
+		handshakes:  make(map[etf.Atom]*handshake),
 		monitors:    make(map[etf.Atom][]etf.Pid),
-		monitorsP:   make(map[etf.Pid][]etf.Pid),
+		monitorsP:   make(map[etf.Pid][]monitorProcess),
+		monitorsN:   make(map[monitorName][]monitorProcess),
+		links:       make(map[etf.Pid][]etf.Pid),
 		procID:      1,
+		refID:       uint64(time.Now().UnixNano()),
+		context:     nodeCtx,
+		cancel:      cancel,
+		listener:    listener,
+		stopping:    make(chan struct{}),
+		closing:     make(chan struct{}),
+		opts:        opts,
+	}
+	for name, c := range opts.Cookies {
+		node.cookies[name] = c
+	}
+	err = node.EPMD.Init(name, listenPort, opts.EPMDHost, opts.EPMDPort, opts.Hidden, opts.DisableEPMDServer)
+	if err != nil {
+		cancel()
+		listener.Close()
+		return nil, err
 	}
 
 	go func() {
 		for {
 			c, err := listener.Accept()
-			lib.Log("Accepted new connection from %s", c.RemoteAddr().String())
 			if err != nil {
+				select {
+				case <-node.stopping:
+					lib.Log("Stop listening")
+					return
+				default:
+				}
 				lib.Log(err.Error())
-			} else {
-				node.run(c, false)
+				continue
 			}
+			lib.Log("Accepted new connection from %s", c.RemoteAddr().String())
+			// silent (or stalled TLS) peer mustn't block the rest of the
+			// incoming connections
+			go func(c net.Conn) {
+				ctx, cancel := context.WithTimeout(nodeCtx, setupTimeout)
+				defer cancel()
+				if err := node.run(ctx, c, ""); err != nil {
+					lib.Log("Incoming connection from %s: %s", c.RemoteAddr().String(), err)
+				}
+			}(c)
 		}
 	}()
 
-	go node.registrator()
-
 	node.sysProcs.netKernel = new(netKernel)
 	node.Spawn(node.sysProcs.netKernel)
 
@@ -180,47 +378,215 @@ func Create(name string, cookie string, ports ...uint16) (node *Node) {
 	node.sysProcs.rpcRex = new(rpcRex)
 	node.Spawn(node.sysProcs.rpcRex)
 
-	return node
+	node.sysProcs.pg = new(pgScope)
+	node.Spawn(node.sysProcs.pg)
+
+	return node, nil
+}
+
+// Stop stops the node gracefully: stops accepting connections, stops all the
+// processes (Terminate callbacks are called with reason 'shutdown'), closes
+// the connections and deregisters the node on EPMD. Processes which haven't
+// exited before the context is done get killed
+func (n *Node) Stop(ctx context.Context) (err error) {
+	stopped := true
+	n.stoppedOnce.Do(func() {
+		stopped = false
+	})
+	if stopped {
+		return errors.New("node is already stopped")
+	}
+
+	lib.Log("Stopping node %s", n.FullName)
+	close(n.stopping)
+	n.listener.Close()
+
+	n.cancel()
+	if !waitGroup(ctx, &n.processes) {
+		err = ctx.Err()
+		n.procLock.RLock()
+		pids := make([]etf.Pid, 0, len(n.channels))
+		for pid := range n.channels {
+			pids = append(pids, pid)
+		}
+		n.procLock.RUnlock()
+		for _, pid := range pids {
+			lib.Log("Process %#v hasn't exited in time. Killing", pid)
+			n.exitSignal(pid, pid, etf.Atom("kill"), false)
+		}
+		n.processes.Wait()
+	}
+
+	// writers send the pending messages and close the connections
+	n.lock.Lock()
+	close(n.closing)
+	n.lock.Unlock()
+	n.conns.Wait()
+
+	n.EPMD.Close()
+	lib.Log("Node %s has been stopped", n.FullName)
+	return
+}
+
+// waitGroup waits for the wait group. Returns false if the context is done before
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // Spawn create new process and store its identificator in table at current node
 func (n *Node) Spawn(pd Process, args ...interface{}) (pid etf.Pid) {
+	return n.SpawnContext(n.context, pd, args...)
+}
+
+// SpawnContext creates new process like Spawn does. Process is stopped with
+// reason 'shutdown' once the given context (or the node context) is done
+func (n *Node) SpawnContext(ctx context.Context, pd Process, args ...interface{}) (pid etf.Pid) {
 	options := pd.Options()
-	chanSize, ok := options["chan-size"].(int)
-	if !ok {
-		chanSize = 100
-	}
+	mailboxSize, _ := options["mailbox-size"].(int)
+	mailboxPolicy, _ := options["mailbox-policy"].(MailboxPolicy)
 
-	in := make(chan etf.Term, chanSize)
-	inFrom := make(chan etf.Tuple, chanSize)
 	initCh := make(chan bool)
+	pctx, cancel := context.WithCancel(ctx)
 	pcs := procChannels{
-		in:     in,
-		inFrom: inFrom,
-		init:   initCh,
+		exit:    make(chan procExit, exitChanSize),
+		init:    initCh,
+		context: pctx,
+		cancel:  cancel,
 	}
+	overflow := func() {
+		pcs.sendExit(procExit{reason: etf.Atom("killed"), kill: true})
+	}
+	pcs.mailbox = newMailbox(mailboxSize, mailboxPolicy, overflow)
 	pid = n.storeProcess(pcs)
 	pd.setNode(n)
 	pd.setPid(pid)
+
+	if ctx != n.context {
+		// process context must be done once the node context is done
+		go func() {
+			select {
+			case <-n.context.Done():
+				cancel()
+			case <-pctx.Done():
+			}
+		}()
+	}
+
+	n.processes.Add(1)
 	go pd.(Behaviour).ProcessLoop(pcs, pd, args...)
 	<-initCh
 	return
 }
 
-// Register associates the name with pid
-func (n *Node) Register(name etf.Atom, pid etf.Pid) {
-	r := regNameReq{name: name, pid: pid}
-	n.registry.regNameChan <- r
+// MailboxInfo returns the state of the mailbox of the local process
+func (n *Node) MailboxInfo(pid etf.Pid) (MailboxInfo, error) {
+	pcs, exists := n.getProcess(pid)
+	if !exists {
+		return MailboxInfo{}, ErrNoProc
+	}
+	return pcs.mailbox.info(), nil
+}
+
+// Register associates the name with the local process like
+// erlang:register/2 does. Every process has at most one name and every name
+// belongs to one process. Name is released once the process exits
+func (n *Node) Register(name etf.Atom, pid etf.Pid) error {
+	n.procLock.Lock()
+	defer n.procLock.Unlock()
+
+	if _, exists := n.channels[pid]; !exists {
+		return ErrNoProc
+	}
+	if p, exists := n.registered[name]; exists {
+		if p == pid {
+			return nil
+		}
+		return ErrNameTaken
+	}
+	for _, p := range n.registered {
+		if p == pid {
+			return ErrProcessNamed
+		}
+	}
+	n.registered[name] = pid
+	return nil
 }
 
 // Unregister removes the registered name
 func (n *Node) Unregister(name etf.Atom) {
-	r := unregNameReq{name: name}
-	n.registry.unregNameChan <- r
+	n.procLock.Lock()
+	delete(n.registered, name)
+	n.procLock.Unlock()
+}
+
+// SetCookie sets the cookie used for the connections to the node like
+// erlang:set_cookie(Node, Cookie) does. Setting the cookie of this node
+// changes the default one. Established connections are not affected
+func (n *Node) SetCookie(node etf.Atom, cookie string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if string(node) == n.FullName {
+		n.Cookie = cookie
+		return
+	}
+	n.cookies[node] = cookie
+}
+
+// GetCookie returns the cookie used for the connections to the node like
+// erlang:get_cookie(Node) does. It's the default cookie unless it's been
+// overridden by SetCookie or Cookies option
+func (n *Node) GetCookie(node etf.Atom) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if cookie, exists := n.cookies[node]; exists {
+		return cookie
+	}
+	return n.Cookie
+}
+
+// Nodes returns the list of visible nodes this node is connected to (like
+// erlang:nodes() does)
+func (n *Node) Nodes() []etf.Atom {
+	return n.nodes(false)
+}
+
+// NodesHidden returns the list of the nodes connected via hidden connections
+// (like erlang:nodes(hidden) does). Connection is hidden if this node or the
+// remote one is hidden
+func (n *Node) NodesHidden() []etf.Atom {
+	return n.nodes(true)
+}
+
+func (n *Node) nodes(hidden bool) (nodes []etf.Atom) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	nodes = []etf.Atom{}
+	for name, conn := range n.connections {
+		if conn.hidden == hidden {
+			nodes = append(nodes, name)
+		}
+	}
+	return
 }
 
 // Registered returns a list of names which have been registered using Register
 func (n *Node) Registered() (pids []etf.Atom) {
+	n.procLock.RLock()
+	defer n.procLock.RUnlock()
+
 	pids = make([]etf.Atom, len(n.registered))
 	i := 0
 	for p, _ := range n.registered {
@@ -230,33 +596,56 @@ func (n *Node) Registered() (pids []etf.Atom) {
 	return
 }
 
-func (n *Node) registrator() {
-	for {
-		select {
-		case req := <-n.registry.storeChan:
-			var pid etf.Pid
-			pid.Node = etf.Atom(n.FullName)
-			pid.Id = n.getProcID()
-			pid.Serial = 1
-			pid.Creation = byte(n.Creation)
+// getProcess returns the channels of the local process
+func (n *Node) getProcess(pid etf.Pid) (pcs procChannels, exists bool) {
+	n.procLock.RLock()
+	pcs, exists = n.channels[pid]
+	n.procLock.RUnlock()
+	return
+}
 
-			n.channels[pid] = req.channels
-			req.replyTo <- pid
-		case req := <-n.registry.regNameChan:
-			n.registered[req.name] = req.pid
-		case req := <-n.registry.unregNameChan:
-			delete(n.registered, req.name)
-		}
-	}
+// Whereis returns the pid of the local process registered with the name like
+// erlang:whereis/1 does
+func (n *Node) Whereis(name etf.Atom) (pid etf.Pid, exists bool) {
+	n.procLock.RLock()
+	pid, exists = n.registered[name]
+	n.procLock.RUnlock()
+	return
 }
 
 func (n *Node) storeProcess(chs procChannels) (pid etf.Pid) {
-	myChan := make(chan etf.Pid)
-	n.registry.storeChan <- regReq{replyTo: myChan, channels: chs}
-	pid = <-myChan
+	pid.Node = etf.Atom(n.FullName)
+	pid.Id = n.getProcID()
+	pid.Serial = 1
+	pid.Creation = n.creation()
+
+	n.procLock.Lock()
+	n.channels[pid] = chs
+	n.procLock.Unlock()
 	return pid
 }
 
+// unregisterProcess removes the process and all its registered names
+func (n *Node) unregisterProcess(pid etf.Pid) {
+	n.procLock.Lock()
+	defer n.procLock.Unlock()
+
+	delete(n.channels, pid)
+	for name, p := range n.registered {
+		if p == pid {
+			delete(n.registered, name)
+		}
+	}
+}
+
+// creation returns creation of the node
+func (n *Node) creation() uint32 {
+	if n.opts.Creation != 0 {
+		return n.opts.Creation
+	}
+	return n.Creation
+}
+
 func (n *Node) getProcID() (s uint32) {
 
 	n.lock.Lock()
@@ -267,56 +656,278 @@ func (n *Node) getProcID() (s uint32) {
 	return
 }
 
-func (n *Node) run(c net.Conn, negotiate bool) {
+// run serves the connection. Handshake is started by this node if it's
+// connecting to the node 'to' (it's empty for the incoming connection).
+// Returns error if the handshake hasn't been completed before the context is
+// done
+func (n *Node) run(ctx context.Context, c net.Conn, to etf.Atom) error {
 
 	var currNd *dist.NodeDesc
 
-	if negotiate {
-		currNd = dist.NewNodeDesc(n.FullName, n.Cookie, false, c)
+	opts := dist.NodeDescOptions{
+		Hidden:   n.opts.Hidden,
+		Flags:    n.opts.DistFlags,
+		Creation: n.creation(),
+		Version:  uint16(n.opts.HandshakeVersion),
+		Status:   n.handshakeStatus,
+		Pending: func() bool {
+			// the node could have connected to this one in the meantime
+			n.lock.Lock()
+			_, exists := n.connections[to]
+			n.lock.Unlock()
+			return !exists
+		},
+		Cookie: func(name string) string {
+			return n.GetCookie(etf.Atom(name))
+		},
+		FragmentSize:   n.opts.FragmentSize,
+		MaxMessageSize: n.opts.MaxMessageSize,
+	}
+	cookie := n.GetCookie(etf.Atom(n.FullName))
+	if to != "" {
+		currNd = dist.NewNodeDesc(n.FullName, cookie, opts, c)
 	} else {
-		currNd = dist.NewNodeDesc(n.FullName, n.Cookie, false, nil)
+		currNd = dist.NewNodeDesc(n.FullName, cookie, opts, nil)
 	}
 
 	wchan := make(chan []etf.Term, 10)
+	replies := newOutbox()
+	readerDone := make(chan struct{})
+	var readerErr error
+	// number of the frames received/sent. Used by the ticker to find out
+	// whether the connection is idle
+	var received, sent uint32
+	// ticker asks the writer to send the tick, so only the writer writes to
+	// the connection
+	tick := make(chan struct{}, 1)
+	// connection goroutines mustn't be added once Stop is waiting for them
+	n.lock.Lock()
+	select {
+	case <-n.closing:
+		n.lock.Unlock()
+		c.Close()
+		return errors.New("node is stopping")
+	default:
+	}
+	n.conns.Add(2)
+	n.lock.Unlock()
 	// run writer routine
 	go func() {
-		for {
-			terms := <-wchan
-			err := currNd.WriteMessage(c, terms)
-			if err != nil {
+		defer n.conns.Done()
+		// fragments of the messages which haven't been sent yet. They are
+		// interleaved with each other and with the rest of the messages
+		var pending [][][]byte
+		writeFrame := func(frame []byte) bool {
+			if _, err := c.Write(frame); err != nil {
 				lib.Log("Enode error (writing): %s", err.Error())
-				break
+				return false
+			}
+			atomic.AddUint32(&sent, 1)
+			return true
+		}
+		write := func(terms []etf.Term) bool {
+			frames, err := currNd.EncodeMessage(terms)
+			if err != nil {
+				lib.Log("Can't encode message %#v: %s", terms, err)
+				return true
+			}
+			if len(frames) > 1 {
+				pending = append(pending, frames[1:])
+			}
+			return writeFrame(frames[0])
+		}
+		// writeFragment sends the next fragment of the first pending message
+		writeFragment := func() bool {
+			frames := pending[0]
+			pending = pending[1:]
+			if len(frames) > 1 {
+				pending = append(pending, frames[1:])
+			}
+			return writeFrame(frames[0])
+		}
+		writeReplies := func() bool {
+			for _, terms := range replies.popAll() {
+				if !write(terms) {
+					return false
+				}
+			}
+			return true
+		}
+		writeTick := func() bool {
+			if err := dist.WriteTick(c); err != nil {
+				lib.Log("Can't send tick to %s: %s", currNd.GetRemoteName(), err)
+				return false
+			}
+			return true
+		}
+	loop:
+		for {
+			if len(pending) > 0 {
+				if !writeFragment() {
+					break loop
+				}
+				select {
+				case terms := <-wchan:
+					if !write(terms) {
+						break loop
+					}
+				case <-replies.ready:
+					if !writeReplies() {
+						break loop
+					}
+				case <-tick:
+					if !writeTick() {
+						break loop
+					}
+				case <-readerDone:
+					break loop
+				default:
+				}
+				continue
+			}
+
+			select {
+			case terms := <-wchan:
+				if !write(terms) {
+					break loop
+				}
+			case <-replies.ready:
+				if !writeReplies() {
+					break loop
+				}
+			case <-tick:
+				if !writeTick() {
+					break loop
+				}
+			case <-readerDone:
+				break loop
+			case <-n.closing:
+				// node is stopping. Send the pending messages and close
+				for {
+					select {
+					case terms := <-wchan:
+						if write(terms) {
+							continue
+						}
+					default:
+						if writeReplies() {
+							for len(pending) > 0 && writeFragment() {
+							}
+						}
+					}
+					break loop
+				}
 			}
 		}
 		c.Close()
-		n.lock.Lock()
-		n.handle_monitors_node(currNd.GetRemoteName())
-		delete(n.connections, currNd.GetRemoteName())
-		n.lock.Unlock()
+		n.connectionClosed(c, currNd.GetRemoteName())
 	}()
 
 	go func() {
+		defer n.conns.Done()
+		defer close(readerDone)
+		ticking := false
 		for {
 			terms, err := currNd.ReadMessage(c)
 			if err != nil {
 				lib.Log("Enode error (reading): %s", err.Error())
+				readerErr = err
 				break
 			}
-			n.handleTerms(c, wchan, terms)
+			atomic.AddUint32(&received, 1)
+			n.handleTerms(c, wchan, replies, terms)
+			if !ticking && currNd.IsConnected() {
+				ticking = true
+				n.conns.Add(1)
+				go n.ticker(c, currNd.GetRemoteName(), &received, &sent, tick, readerDone)
+			}
 		}
 		c.Close()
-		n.lock.Lock()
-		n.handle_monitors_node(currNd.GetRemoteName())
-		delete(n.connections, currNd.GetRemoteName())
-		n.lock.Unlock()
+		n.connectionClosed(c, currNd.GetRemoteName())
 	}()
 
-	<-currNd.Ready
+	select {
+	case <-currNd.Ready:
+		return nil
+	case <-readerDone:
+		switch readerErr {
+		case dist.ErrStatusNok, dist.ErrStatusNotAllowed, dist.ErrStatusAlive:
+			return readerErr
+		}
+		return fmt.Errorf("Connection has been closed during handshake")
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
 
-	return
+// ticker asks the writer to send the tick over the idle connection and
+// closes it once nothing has been received from the node during the TickTime
+func (n *Node) ticker(c net.Conn, name etf.Atom, received, sent *uint32, tick chan struct{}, done chan struct{}) {
+	defer n.conns.Done()
+	interval := time.Duration(n.opts.TickTime) * time.Second / tickTimeouts
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	lastReceived := atomic.LoadUint32(received)
+	lastSent := atomic.LoadUint32(sent)
+	missed := 0
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+
+		if r := atomic.LoadUint32(received); r != lastReceived {
+			lastReceived = r
+			missed = 0
+		} else if missed++; missed >= tickTimeouts {
+			lib.Log("Node %s is not responding (tick time %ds). Closing connection", name, n.opts.TickTime)
+			c.Close()
+			return
+		}
+
+		if s := atomic.LoadUint32(sent); s != lastSent {
+			lastSent = s
+			continue
+		}
+		select {
+		case tick <- struct{}{}:
+		default:
+			// previous one hasn't been sent yet
+		}
+	}
+}
+
+// TickTime returns the tick time of the node (in seconds)
+func (n *Node) TickTime() int {
+	return n.opts.TickTime
+}
+
+// connectionClosed cleans up everything related to the closed connection
+// to the node. Does nothing if the connection hasn't been registered (e.g.
+// handshake has failed) or it has been already cleaned up
+func (n *Node) connectionClosed(c net.Conn, name etf.Atom) {
+	n.lock.Lock()
+	conn, exists := n.connections[name]
+	if !exists || conn.conn != c {
+		n.lock.Unlock()
+		return
+	}
+	n.handle_monitors_node(name)
+	delete(n.connections, name)
+	n.lock.Unlock()
+	if !conn.hidden {
+		n.nodesEvent(etf.Atom("nodedown"), name)
+	}
+	n.handle_links_node(name)
+	n.handle_monitors_process_node(name)
 }
 
-func (n *Node) handleTerms(c net.Conn, wchan chan []etf.Term, terms []etf.Term) {
+// handleTerms handles the message received from the node. Replies are
+// queued to the outbox, so the reader is never blocked
+func (n *Node) handleTerms(c net.Conn, wchan chan []etf.Term, replies *outbox, terms []etf.Term) {
 	lib.Log("Node terms: %#v", terms)
 
 	if len(terms) == 0 {
@@ -325,42 +936,123 @@ func (n *Node) handleTerms(c net.Conn, wchan chan []etf.Term, terms []etf.Term)
 	switch t := terms[0].(type) {
 	case etf.Tuple:
 		if len(t) > 0 {
+			malformed := func() {
+				lib.Log("*** ERROR: malformed control message: %#v", terms)
+			}
 			switch act := t.Element(1).(type) {
 			case int:
 				switch act {
 				case REG_SEND:
-					if len(terms) == 2 {
-						n.route(t.Element(2), t.Element(4), terms[1])
-					} else {
-						lib.Log("*** ERROR: bad REG_SEND: %#v", terms)
+					// {6, FromPid, Unused, ToName}
+					if len(t) != 4 || len(terms) != 2 {
+						malformed()
+						return
 					}
+					n.route(t.Element(2), t.Element(4), terms[1])
 				case SEND:
+					// {2, Unused, ToPid}
+					if len(t) != 3 || len(terms) != 2 {
+						malformed()
+						return
+					}
 					n.route(nil, t.Element(3), terms[1])
 
-				// Not implemented yet, just stubs. TODO.
 				case LINK:
+					// {1, FromPid, ToPid}
 					lib.Log("LINK message (act %d): %#v", act, t)
+					from, to, ok := controlPids(t, 3, 2, 3)
+					if !ok {
+						malformed()
+						return
+					}
+					n.remoteLink(replies, from, to)
 				case UNLINK:
+					// {4, FromPid, ToPid}
 					lib.Log("UNLINK message (act %d): %#v", act, t)
-				case NODE_LINK:
-					lib.Log("NODE_LINK message (act %d): %#v", act, t)
+					from, to, ok := controlPids(t, 3, 2, 3)
+					if !ok {
+						malformed()
+						return
+					}
+					n.removeLink(from, to)
+				case UNLINK_ID:
+					// {35, Id, FromPid, ToPid}
+					lib.Log("UNLINK_ID message (act %d): %#v", act, t)
+					from, to, ok := controlPids(t, 4, 3, 4)
+					if !ok {
+						malformed()
+						return
+					}
+					n.removeLink(from, to)
+					replies.push([]etf.Term{etf.Tuple{UNLINK_ID_ACK, t.Element(2), to, from}})
+				case UNLINK_ID_ACK:
+					// {36, Id, FromPid, ToPid}
+					lib.Log("UNLINK_ID_ACK message (act %d): %#v", act, t)
 				case EXIT:
+					// {3, FromPid, ToPid, Reason}
 					lib.Log("EXIT message (act %d): %#v", act, t)
+					from, to, ok := controlPids(t, 4, 2, 3)
+					if !ok {
+						malformed()
+						return
+					}
+					n.removeLink(from, to)
+					n.exitSignal(from, to, t.Element(4), true)
 				case EXIT2:
+					// {8, FromPid, ToPid, Reason}
 					lib.Log("EXIT2 message (act %d): %#v", act, t)
+					from, to, ok := controlPids(t, 4, 2, 3)
+					if !ok {
+						malformed()
+						return
+					}
+					n.exitSignal(from, to, t.Element(4), false)
+
+				// Not implemented yet, just stubs. TODO.
+				case NODE_LINK:
+					lib.Log("NODE_LINK message (act %d): %#v", act, t)
 				case MONITOR:
+					// {19, FromPid, ToProc, Ref}
 					lib.Log("MONITOR message (act %d): %#v", act, t)
+					if len(t) != 4 {
+						malformed()
+						return
+					}
+					from, ok1 := t.Element(2).(etf.Pid)
+					ref, ok2 := t.Element(4).(etf.Ref)
+					if !ok1 || !ok2 {
+						malformed()
+						return
+					}
+					n.remoteMonitor(replies, from, t.Element(3), ref)
 				case DEMONITOR:
+					// {20, FromPid, ToProc, Ref}
 					lib.Log("DEMONITOR message (act %d): %#v", act, t)
+					if len(t) != 4 {
+						malformed()
+						return
+					}
+					ref, ok := t.Element(4).(etf.Ref)
+					if !ok {
+						malformed()
+						return
+					}
+					n.removeMonitor(ref)
 				case MONITOR_EXIT:
+					// {21, FromProc, ToPid, Ref, Reason}
 					lib.Log("MONITOR_EXIT message (act %d): %#v", act, t)
-
-					// {'DOWN',#Ref<0.0.13893633.237772>,process,<26194.4.1>,reason}
-					M := etf.Term(etf.Tuple{etf.Atom("DOWN"),
-						t.Element(3), etf.Atom("process"),
-						t.Element(2), t.Element(5)})
-
-					n.route(t.Element(2), t.Element(3), M)
+					if len(t) != 5 {
+						malformed()
+						return
+					}
+					ref, ok := t.Element(4).(etf.Ref)
+					if !ok {
+						malformed()
+						return
+					}
+					if to, m, ok := n.removeMonitor(ref); ok {
+						n.sendDown(m.process, ref, to, t.Element(5))
+					}
 
 				default:
 					lib.Log("Unhandled node message (act %d): %#v", act, t)
@@ -369,9 +1061,29 @@ func (n *Node) handleTerms(c net.Conn, wchan chan []etf.Term, terms []etf.Term)
 				switch act {
 				case etf.Atom("$connection"):
 					lib.Log("SET NODE %#v", t)
+					name := t[1].(etf.Atom)
+					hidden, _ := t[3].(bool)
+					flags, _ := t[4].(uint64)
+					n.lock.Lock()
+					old, exists := n.connections[name]
+					n.lock.Unlock()
+					if exists && old.conn != c {
+						// remote node has asked to replace the
+						// connection (handshake status 'alive')
+						lib.Log("Replace connection to %s", name)
+						n.connectionClosed(old.conn, name)
+						old.conn.Close()
+					}
 					n.lock.Lock()
-					n.connections[t[1].(etf.Atom)] = nodeConn{conn: c, wchan: wchan}
+					n.connections[name] = nodeConn{conn: c, wchan: wchan, hidden: hidden, flags: flags}
+					if hs, exists := n.handshakes[name]; exists && hs.connected != nil {
+						close(hs.connected)
+						hs.connected = nil
+					}
 					n.lock.Unlock()
+					if !hidden {
+						n.nodesEvent(etf.Atom("nodeup"), name)
+					}
 
 					// currNd.Ready channel waiting for registration of this connection
 					ready := (t[2]).(chan bool)
@@ -384,6 +1096,19 @@ func (n *Node) handleTerms(c net.Conn, wchan chan []etf.Term, terms []etf.Term)
 	}
 }
 
+// controlPids returns the pids of the control message with the given size
+// at the positions 'from' and 'to'. Returns false if the message is malformed
+func controlPids(t etf.Tuple, size, from, to int) (fromPid, toPid etf.Pid, ok bool) {
+	if len(t) != size {
+		return
+	}
+	if fromPid, ok = t.Element(from).(etf.Pid); !ok {
+		return
+	}
+	toPid, ok = t.Element(to).(etf.Pid)
+	return
+}
+
 // route incomming message to registered (with sender 'from' value)
 func (n *Node) route(from, to etf.Term, message etf.Term) {
 	var toPid etf.Pid
@@ -391,20 +1116,29 @@ func (n *Node) route(from, to etf.Term, message etf.Term) {
 	case etf.Pid:
 		toPid = tp
 	case etf.Atom:
-		toPid, _ = n.registered[tp]
+		toPid, _ = n.Whereis(tp)
+	}
+	pcs, exists := n.getProcess(toPid)
+	if !exists {
+		lib.Log("Message to unknown process %#v is dropped: %#v", to, message)
+		return
 	}
-	pcs := n.channels[toPid]
 	if from == nil {
 		lib.Log("SEND: To: %#v, Message: %#v", to, message)
-		pcs.in <- message
 	} else {
-		lib.Log("REG_SEND: (%#v )From: %#v, To: %#v, Message: %#v", pcs.inFrom, from, to, message)
-		pcs.inFrom <- etf.Tuple{from, message}
+		lib.Log("REG_SEND: From: %#v, To: %#v, Message: %#v", from, to, message)
 	}
+	pcs.mailbox.push(from, message)
 }
 
 // Send making outgoing message
 func (n *Node) Send(from interface{}, to interface{}, message *etf.Term) (err error) {
+	return n.SendContext(n.context, from, to, message)
+}
+
+// SendContext makes outgoing message like Send does. Connection to the
+// remote node (if it's needed) is aborted once the context is done
+func (n *Node) SendContext(ctx context.Context, from interface{}, to interface{}, message *etf.Term) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New(fmt.Sprint(r))
@@ -413,38 +1147,49 @@ func (n *Node) Send(from interface{}, to interface{}, message *etf.Term) (err er
 
 	switch tto := to.(type) {
 	case etf.Pid:
-		n.sendbyPid(tto, message)
+		n.sendbyPid(ctx, tto, message)
+	case etf.Atom:
+		// registered name of the local process
+		n.route(from, tto, *message)
 	case etf.Tuple:
+		if len(tto) == 2 && tto[0] == etf.Atom("global") {
+			// {global, Name} is the name registered in the cluster
+			pid, exists := n.WhereisGlobal(tto[1])
+			if !exists {
+				return ErrNoProc
+			}
+			n.sendbyPid(ctx, pid, message)
+			return nil
+		}
 		if len(tto) == 2 {
 			// causes panic if casting to etf.Atom goes wrong
 			if tto[0].(etf.Atom) == tto[1].(etf.Atom) {
 				// just stub.
 			}
-			n.sendbyTuple(from.(etf.Pid), tto, message)
+			n.sendbyTuple(ctx, from.(etf.Pid), tto, message)
 		}
 	}
 
 	return nil
 }
 
-func (n *Node) sendbyPid(to etf.Pid, message *etf.Term) {
-	var conn nodeConn
-	var exists bool
+func (n *Node) sendbyPid(ctx context.Context, to etf.Pid, message *etf.Term) {
 	lib.Log("Send (via PID): %#v, %#v", to, message)
 	if string(to.Node) == n.FullName {
 		lib.Log("Send to local node")
-		pcs := n.channels[to]
-		pcs.in <- *message
+		pcs, exists := n.getProcess(to)
+		if !exists {
+			lib.Log("Message to unknown process %#v is dropped", to)
+			return
+		}
+		pcs.mailbox.push(nil, *message)
 	} else {
 
-		lib.Log("Send to remote node: %#v, %#v", to, n.connections[to.Node])
+		lib.Log("Send to remote node: %#v", to)
 
-		if conn, exists = n.connections[to.Node]; !exists {
-			lib.Log("Send (via PID): create new connection (%s)", to.Node)
-			if err := connect(n, to.Node); err != nil {
-				panic(err.Error())
-			}
-			conn, _ = n.connections[to.Node]
+		conn, err := n.getConnection(ctx, to.Node)
+		if err != nil {
+			panic(err.Error())
 		}
 
 		msg := []etf.Term{etf.Tuple{SEND, etf.Atom(""), to}, *message}
@@ -452,19 +1197,18 @@ func (n *Node) sendbyPid(to etf.Pid, message *etf.Term) {
 	}
 }
 
-func (n *Node) sendbyTuple(from etf.Pid, to etf.Tuple, message *etf.Term) {
-	var conn nodeConn
-	var exists bool
+func (n *Node) sendbyTuple(ctx context.Context, from etf.Pid, to etf.Tuple, message *etf.Term) {
 	lib.Log("Send (via NAME): %#v, %#v", to, message)
 
 	// to = {processname, 'nodename@hostname'}
+	if string(to[1].(etf.Atom)) == n.FullName {
+		n.route(from, to[0], *message)
+		return
+	}
 
-	if conn, exists = n.connections[to[1].(etf.Atom)]; !exists {
-		lib.Log("Send (via NAME): create new connection (%s)", to[1])
-		if err := connect(n, to[1].(etf.Atom)); err != nil {
-			panic(err.Error())
-		}
-		conn, _ = n.connections[to[1].(etf.Atom)]
+	conn, err := n.getConnection(ctx, to[1].(etf.Atom))
+	if err != nil {
+		panic(err.Error())
 	}
 
 	msg := []etf.Term{etf.Tuple{REG_SEND, from, etf.Atom(""), to[0]}, *message}
@@ -473,46 +1217,374 @@ func (n *Node) sendbyTuple(from etf.Pid, to etf.Tuple, message *etf.Term) {
 	return
 }
 
-func (n *Node) Monitor(by etf.Pid, to etf.Pid) {
-	var conn nodeConn
-	var exists bool
+// Monitor sets up monitor of the process 'to' by the process 'by' and returns
+// monitor reference. Process could be specified by etf.Pid or by registered
+// name as etf.Tuple{Name, Node} (etf.Atom for the local one). Process 'by' receives
+// {'DOWN', Ref, process, Pid, Reason} message (via HandleInfo) once 'to' exits
+// or its node gets disconnected. Monitor created by name delivers
+// {'DOWN', Ref, process, {Name, Node}, Reason}
+func (n *Node) Monitor(by etf.Pid, to interface{}) (ref etf.Ref) {
+	ref = n.MakeRef()
+	n.monitorRef(n.context, by, to, ref)
+	return
+}
 
+// monitorRef sets up monitor using the given reference. Connection to the
+// remote node (if it's needed) is aborted once the context is done
+func (n *Node) monitorRef(ctx context.Context, by etf.Pid, to interface{}, ref etf.Ref) {
+	switch t := to.(type) {
+	case etf.Pid:
+		n.monitorPid(ctx, by, t, ref)
+	case etf.Atom:
+		n.monitorName(ctx, by, monitorName{name: t, node: etf.Atom(n.FullName)}, ref)
+	case etf.Tuple:
+		if len(t) != 2 {
+			n.sendDown(by, ref, t, etf.Atom("badarg"))
+			return
+		}
+		if t[0] == etf.Atom("global") {
+			pid, exists := n.WhereisGlobal(t[1])
+			if !exists {
+				n.sendDown(by, ref, t, etf.Atom("noproc"))
+				return
+			}
+			n.monitorPid(ctx, by, pid, ref)
+			return
+		}
+		name, ok1 := t[0].(etf.Atom)
+		node, ok2 := t[1].(etf.Atom)
+		if !ok1 || !ok2 {
+			n.sendDown(by, ref, t, etf.Atom("badarg"))
+			return
+		}
+		n.monitorName(ctx, by, monitorName{name: name, node: node}, ref)
+	default:
+		lib.Log("Monitor: wrong target %#v", to)
+	}
+}
+
+func (n *Node) monitorPid(ctx context.Context, by, to etf.Pid, ref etf.Ref) {
 	if string(to.Node) == n.FullName {
 		lib.Log("Monitor local PID: %#v by %#v", to, by)
+		if _, exists := n.getProcess(to); !exists {
+			n.sendDown(by, ref, to, etf.Atom("noproc"))
+			return
+		}
+		n.addMonitor(to, monitorProcess{process: by, ref: ref})
+		return
+	}
+
+	lib.Log("Monitor remote PID: %#v by %#v", to, by)
+	conn, err := n.getConnection(ctx, to.Node)
+	if err != nil {
+		lib.Log("Monitor: can't connect to %s: %s", to.Node, err)
+		n.sendDown(by, ref, to, etf.Atom("noconnection"))
+		return
+	}
+
+	n.addMonitor(to, monitorProcess{process: by, ref: ref})
+	conn.wchan <- []etf.Term{etf.Tuple{MONITOR, by, to, ref}}
+}
 
-		pcs := n.channels[to]
-		msg := []etf.Term{etf.Tuple{MONITOR, by, to, n.MakeRef()}}
-		pcs.in <- msg
+func (n *Node) monitorName(ctx context.Context, by etf.Pid, to monitorName, ref etf.Ref) {
+	down := etf.Tuple{to.name, to.node}
 
+	if string(to.node) == n.FullName {
+		lib.Log("Monitor local name: %#v by %#v", to.name, by)
+		pid, exists := n.Whereis(to.name)
+		if !exists {
+			n.sendDown(by, ref, down, etf.Atom("noproc"))
+			return
+		}
+		if _, exists := n.getProcess(pid); !exists {
+			n.sendDown(by, ref, down, etf.Atom("noproc"))
+			return
+		}
+		n.addMonitor(pid, monitorProcess{process: by, ref: ref, name: to.name})
 		return
 	}
 
-	lib.Log("Monitor remote PID: %#v by %#v", to, by)
+	lib.Log("Monitor remote name: %#v by %#v", down, by)
+	conn, err := n.getConnection(ctx, to.node)
+	if err != nil {
+		lib.Log("Monitor: can't connect to %s: %s", to.node, err)
+		n.sendDown(by, ref, down, etf.Atom("noconnection"))
+		return
+	}
 
-	if conn, exists = n.connections[to.Node]; !exists {
-		lib.Log("Send (via PID): create new connection (%s)", to.Node)
-		if err := connect(n, to.Node); err != nil {
-			panic(err.Error())
+	n.lock.Lock()
+	n.monitorsN[to] = append(n.monitorsN[to], monitorProcess{process: by, ref: ref, name: to.name})
+	n.lock.Unlock()
+	conn.wchan <- []etf.Term{etf.Tuple{MONITOR, by, to.name, ref}}
+}
+
+// Demonitor removes the monitor by its reference. Returns false if there
+// was no such monitor
+func (n *Node) Demonitor(ref etf.Ref) bool {
+	to, m, found := n.removeMonitor(ref)
+	if !found {
+		return false
+	}
+
+	var node etf.Atom
+	var toProc etf.Term
+	switch t := to.(type) {
+	case etf.Pid:
+		node, toProc = t.Node, t
+	case etf.Tuple:
+		node, toProc = t[1].(etf.Atom), t[0]
+	}
+
+	if string(node) != n.FullName {
+		n.lock.Lock()
+		conn, exists := n.connections[node]
+		n.lock.Unlock()
+		if exists {
+			conn.wchan <- []etf.Term{etf.Tuple{DEMONITOR, m.process, toProc, ref}}
 		}
-		conn, _ = n.connections[to.Node]
 	}
+	return true
+}
 
-	msg := []etf.Term{etf.Tuple{MONITOR, by, to, n.MakeRef()}}
-	conn.wchan <- msg
+func (n *Node) addMonitor(to etf.Pid, m monitorProcess) {
+	n.lock.Lock()
+	n.monitorsP[to] = append(n.monitorsP[to], m)
+	n.lock.Unlock()
+}
+
+// removeMonitor removes the monitor by its reference and returns the
+// monitored process in the form it has to be reported in 'DOWN' message:
+// etf.Pid or etf.Tuple{Name, Node} for the monitors created by name
+func (n *Node) removeMonitor(ref etf.Ref) (to etf.Term, m monitorProcess, removed bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for pid, monitors := range n.monitorsP {
+		for i, mp := range monitors {
+			if !isRefEqual(mp.ref, ref) {
+				continue
+			}
+			m, removed = mp, true
+			if mp.name != "" {
+				to = etf.Tuple{mp.name, pid.Node}
+			} else {
+				to = pid
+			}
+			monitors = append(monitors[:i], monitors[i+1:]...)
+			if len(monitors) > 0 {
+				n.monitorsP[pid] = monitors
+			} else {
+				delete(n.monitorsP, pid)
+			}
+			return
+		}
+	}
+
+	for name, monitors := range n.monitorsN {
+		for i, mp := range monitors {
+			if !isRefEqual(mp.ref, ref) {
+				continue
+			}
+			m, removed = mp, true
+			to = etf.Tuple{name.name, name.node}
+			monitors = append(monitors[:i], monitors[i+1:]...)
+			if len(monitors) > 0 {
+				n.monitorsN[name] = monitors
+			} else {
+				delete(n.monitorsN, name)
+			}
+			return
+		}
+	}
+	return
+}
+
+// remoteMonitor handles MONITOR request from the remote process 'by'.
+// Process 'to' could be a pid or registered name (DIST_MONITOR_NAME)
+func (n *Node) remoteMonitor(replies *outbox, by etf.Pid, to etf.Term, ref etf.Ref) {
+	var pid etf.Pid
+	var name etf.Atom
+	var exists bool
+
+	switch t := to.(type) {
+	case etf.Pid:
+		pid = t
+	case etf.Atom:
+		name = t
+		pid, exists = n.Whereis(name)
+	}
+
+	if _, exists = n.getProcess(pid); !exists {
+		lib.Log("MONITOR of unknown process %#v. Reply with 'noproc'", to)
+		replies.push([]etf.Term{etf.Tuple{MONITOR_EXIT, to, by, ref, etf.Atom("noproc")}})
+		return
+	}
+	n.addMonitor(pid, monitorProcess{process: by, ref: ref, name: name})
+}
+
+// sendDown sends {'DOWN', Ref, process, Pid, Reason} message to the local
+// process 'to'
+func (n *Node) sendDown(to etf.Pid, ref etf.Ref, pid etf.Term, reason etf.Term) {
+	down := etf.Term(etf.Tuple{etf.Atom("DOWN"), ref, etf.Atom("process"), pid, reason})
+	n.route(nil, to, down)
 }
 
+// handle_monitors_process_exit notifies all the monitors of the exited
+// process and removes monitors this process had set up
+func (n *Node) handle_monitors_process_exit(pid etf.Pid, reason etf.Term) {
+	type demonitor struct {
+		node etf.Atom
+		msg  etf.Tuple
+	}
+	var demonitors []demonitor
+
+	n.lock.Lock()
+	monitors := n.monitorsP[pid]
+	delete(n.monitorsP, pid)
+	for to, mps := range n.monitorsP {
+		keep := mps[:0]
+		for _, mp := range mps {
+			if mp.process == pid {
+				demonitors = append(demonitors, demonitor{to.Node, etf.Tuple{DEMONITOR, pid, to, mp.ref}})
+				continue
+			}
+			keep = append(keep, mp)
+		}
+		if len(keep) > 0 {
+			n.monitorsP[to] = keep
+		} else {
+			delete(n.monitorsP, to)
+		}
+	}
+	for to, mps := range n.monitorsN {
+		keep := mps[:0]
+		for _, mp := range mps {
+			if mp.process == pid {
+				demonitors = append(demonitors, demonitor{to.node, etf.Tuple{DEMONITOR, pid, to.name, mp.ref}})
+				continue
+			}
+			keep = append(keep, mp)
+		}
+		if len(keep) > 0 {
+			n.monitorsN[to] = keep
+		} else {
+			delete(n.monitorsN, to)
+		}
+	}
+	n.lock.Unlock()
+
+	for _, m := range monitors {
+		if string(m.process.Node) == n.FullName {
+			if m.name != "" {
+				n.sendDown(m.process, m.ref, etf.Tuple{m.name, pid.Node}, reason)
+			} else {
+				n.sendDown(m.process, m.ref, pid, reason)
+			}
+			continue
+		}
+
+		n.lock.Lock()
+		conn, exists := n.connections[m.process.Node]
+		n.lock.Unlock()
+		if !exists {
+			continue
+		}
+		if m.name != "" {
+			conn.wchan <- []etf.Term{etf.Tuple{MONITOR_EXIT, m.name, m.process, m.ref, reason}}
+		} else {
+			conn.wchan <- []etf.Term{etf.Tuple{MONITOR_EXIT, pid, m.process, m.ref, reason}}
+		}
+	}
+
+	for _, d := range demonitors {
+		if string(d.node) == n.FullName {
+			continue
+		}
+		n.lock.Lock()
+		conn, exists := n.connections[d.node]
+		n.lock.Unlock()
+		if exists {
+			conn.wchan <- []etf.Term{d.msg}
+		}
+	}
+}
+
+// handle_monitors_process_node sends 'DOWN' messages with reason 'noconnection'
+// to the local processes monitoring processes on the node which went down and
+// removes monitors set up by the processes of that node
+func (n *Node) handle_monitors_process_node(node etf.Atom) {
+	type down struct {
+		to etf.Term
+		m  monitorProcess
+	}
+	var downs []down
+
+	n.lock.Lock()
+	for pid, mps := range n.monitorsP {
+		if pid.Node == node {
+			for _, mp := range mps {
+				downs = append(downs, down{pid, mp})
+			}
+			delete(n.monitorsP, pid)
+			continue
+		}
+
+		keep := mps[:0]
+		for _, mp := range mps {
+			if mp.process.Node != node {
+				keep = append(keep, mp)
+			}
+		}
+		if len(keep) > 0 {
+			n.monitorsP[pid] = keep
+		} else {
+			delete(n.monitorsP, pid)
+		}
+	}
+	for name, mps := range n.monitorsN {
+		if name.node != node {
+			continue
+		}
+		for _, mp := range mps {
+			downs = append(downs, down{etf.Tuple{name.name, name.node}, mp})
+		}
+		delete(n.monitorsN, name)
+	}
+	n.lock.Unlock()
+
+	for _, d := range downs {
+		n.sendDown(d.m.process, d.m.ref, d.to, etf.Atom("noconnection"))
+	}
+}
+
+// MonitorNode sets (flag is true) or removes the monitor of the node like
+// erlang:monitor_node/2 does. Process 'by' receives {nodedown, Node} once
+// the node is down (immediately if it can't be connected). Every monitor
+// fires only once
 func (n *Node) MonitorNode(by etf.Pid, node etf.Atom, flag bool) {
 	var exists bool
 	var monitors []etf.Pid
 
 	lib.Log("Monitor node: %#v by %#v", node, by)
-	if _, exists = n.connections[node]; !exists {
+	n.lock.Lock()
+	_, exists = n.connections[node]
+	n.lock.Unlock()
+	if !exists && flag {
 		lib.Log("... connecting to %#v", node)
-		if err := connect(n, node); err != nil {
-			panic(err.Error())
+		if err := connect(n.context, n, node); err != nil {
+			lib.Log("... can't connect to %#v: %s", node, err)
+			n.sendNodedown(by, node)
+			return
 		}
 	}
 
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, exists = n.connections[node]; !exists && flag {
+		// connection has been closed in the meantime
+		n.sendNodedown(by, node)
+		return
+	}
 	monitors = n.monitors[node]
 
 	if !flag {
@@ -530,55 +1602,445 @@ func (n *Node) MonitorNode(by etf.Pid, node etf.Atom, flag bool) {
 		monitors = append(monitors, by)
 	}
 
-	n.monitors[node] = monitors
+	if len(monitors) == 0 {
+		delete(n.monitors, node)
+	} else {
+		n.monitors[node] = monitors
+	}
 	lib.Log("Monitors for node (%#v): %#v", node, monitors)
 
 }
 
+// handle_monitors_node sends 'nodedown' to the monitors of the node and
+// removes them. Must be called with n.lock held
 func (n *Node) handle_monitors_node(node etf.Atom) {
 	lib.Log("Node (%#v) is down. Send it to %#v", node, n.monitors[node])
 	for _, pid := range n.monitors[node] {
-		pcs := n.channels[pid]
-		msg := etf.Term(etf.Tuple{etf.Atom("nodedown"), node})
-		pcs.in <- msg
+		n.sendNodedown(pid, node)
+	}
+	delete(n.monitors, node)
+}
+
+// monitorNodes subscribes (flag is true) the process to {nodeup, Node} and
+// {nodedown, Node} messages of all the visible nodes like
+// net_kernel:monitor_nodes/1 does
+func (n *Node) monitorNodes(by etf.Pid, flag bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.monitorsA = removePid(n.monitorsA, by)
+	if flag {
+		n.monitorsA = append(n.monitorsA, by)
+	}
+}
+
+// nodesEvent sends {Event, Node} to the processes monitoring all the nodes
+func (n *Node) nodesEvent(event, node etf.Atom) {
+	n.lock.Lock()
+	pids := append([]etf.Pid{}, n.monitorsA...)
+	n.lock.Unlock()
+	for _, pid := range pids {
+		if pcs, exists := n.getProcess(pid); exists {
+			pcs.mailbox.push(nil, etf.Tuple{event, node})
+		}
+	}
+}
+
+// sendNodedown puts {nodedown, Node} into the mailbox of the local process
+func (n *Node) sendNodedown(to etf.Pid, node etf.Atom) {
+	pcs, exists := n.getProcess(to)
+	if !exists {
+		return
+	}
+	msg := etf.Term(etf.Tuple{etf.Atom("nodedown"), node})
+	pcs.mailbox.push(nil, msg)
+}
+
+// Link creates a bidirectional link between processes 'by' and 'to'.
+// If 'to' doesn't exist (or its node is unreachable) 'by' receives an exit
+// signal with reason 'noproc' ('noconnection')
+func (n *Node) Link(by, to etf.Pid) {
+	if by == to {
+		return
+	}
+
+	if string(to.Node) == n.FullName {
+		lib.Log("Link local PID: %#v by %#v", to, by)
+		if _, exists := n.getProcess(to); !exists {
+			n.exitSignal(to, by, etf.Atom("noproc"), true)
+			return
+		}
+		n.addLink(by, to)
+		return
+	}
+
+	lib.Log("Link remote PID: %#v by %#v", to, by)
+	conn, err := n.getConnection(n.context, to.Node)
+	if err != nil {
+		lib.Log("Link: can't connect to %s: %s", to.Node, err)
+		n.exitSignal(to, by, etf.Atom("noconnection"), true)
+		return
+	}
+	n.addLink(by, to)
+	conn.wchan <- []etf.Term{etf.Tuple{LINK, by, to}}
+}
+
+// Unlink removes the link between processes 'by' and 'to' (if any)
+func (n *Node) Unlink(by, to etf.Pid) {
+	if !n.removeLink(by, to) {
+		return
+	}
+	if string(to.Node) == n.FullName {
+		return
+	}
+
+	n.lock.Lock()
+	conn, exists := n.connections[to.Node]
+	n.lock.Unlock()
+	if !exists {
+		return
+	}
+	if conn.flags&dist.UNLINK_ID != 0 {
+		// required by OTP 26+
+		id := atomic.AddUint64(&n.unlinkID, 1)
+		conn.wchan <- []etf.Term{etf.Tuple{UNLINK_ID, id, by, to}}
+		return
+	}
+	conn.wchan <- []etf.Term{etf.Tuple{UNLINK, by, to}}
+}
+
+func (n *Node) addLink(a, b etf.Pid) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, p := range n.links[a] {
+		if p == b {
+			// already linked
+			return
+		}
+	}
+	n.links[a] = append(n.links[a], b)
+	n.links[b] = append(n.links[b], a)
+}
+
+func (n *Node) removeLink(a, b etf.Pid) (removed bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, p := range n.links[a] {
+		if p == b {
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return
+	}
+
+	if l := removePid(n.links[a], b); len(l) > 0 {
+		n.links[a] = l
+	} else {
+		delete(n.links, a)
+	}
+	if l := removePid(n.links[b], a); len(l) > 0 {
+		n.links[b] = l
+	} else {
+		delete(n.links, b)
+	}
+	return
+}
+
+// remoteLink handles LINK request from the remote process 'from'
+func (n *Node) remoteLink(replies *outbox, from, to etf.Pid) {
+	if _, exists := n.getProcess(to); !exists {
+		lib.Log("LINK to unknown process %#v. Reply with 'noproc'", to)
+		replies.push([]etf.Term{etf.Tuple{EXIT, to, from, etf.Atom("noproc")}})
+		return
+	}
+	n.addLink(from, to)
+}
+
+// Exit sends an exit signal with given reason to the process 'to'
+// like erlang:exit/2 does. Reason 'kill' can't be trapped.
+func (n *Node) Exit(from, to etf.Pid, reason etf.Term) {
+	if string(to.Node) == n.FullName {
+		n.exitSignal(from, to, reason, false)
+		return
+	}
+
+	n.lock.Lock()
+	conn, exists := n.connections[to.Node]
+	n.lock.Unlock()
+	if exists {
+		conn.wchan <- []etf.Term{etf.Tuple{EXIT2, from, to, reason}}
+	}
+}
+
+// exitSignal delivers exit signal from 'from' to the local process 'to'.
+// Process decides how to handle it depending on its trap_exit flag
+func (n *Node) exitSignal(from, to etf.Pid, reason etf.Term, link bool) {
+	pcs, exists := n.getProcess(to)
+	if !exists {
+		return
+	}
+
+	lib.Log("Exit signal to %#v from %#v with reason %#v", to, from, reason)
+	pcs.sendExit(procExit{
+		from:   from,
+		reason: reason,
+		kill:   !link && reason == etf.Atom("kill"),
+	})
+}
+
+// processExited cleans up everything related to the exited process and
+// sends exit signals with given reason to all the processes linked to it
+func (n *Node) processExited(pid etf.Pid, reason etf.Term) {
+	defer n.processes.Done()
+	if pcs, exists := n.getProcess(pid); exists && pcs.cancel != nil {
+		defer pcs.cancel()
+	}
+	n.unregisterProcess(pid)
+
+	n.lock.Lock()
+	for node, pids := range n.monitors {
+		for {
+			l := removePid(pids, pid)
+			if len(l) == len(pids) {
+				break
+			}
+			pids = l
+		}
+		if len(pids) > 0 {
+			n.monitors[node] = pids
+		} else {
+			delete(n.monitors, node)
+		}
+	}
+	n.monitorsA = removePid(n.monitorsA, pid)
+
+	linked := n.links[pid]
+	delete(n.links, pid)
+	for _, p := range linked {
+		if l := removePid(n.links[p], pid); len(l) > 0 {
+			n.links[p] = l
+		} else {
+			delete(n.links, p)
+		}
+	}
+	n.lock.Unlock()
+
+	n.handle_monitors_process_exit(pid, reason)
+
+	lib.Log("Process %#v exited (%#v). Linked: %#v", pid, reason, linked)
+	for _, p := range linked {
+		if string(p.Node) == n.FullName {
+			n.exitSignal(pid, p, reason, true)
+			continue
+		}
+
+		n.lock.Lock()
+		conn, exists := n.connections[p.Node]
+		n.lock.Unlock()
+		if exists {
+			conn.wchan <- []etf.Term{etf.Tuple{EXIT, pid, p, reason}}
+		}
+	}
+}
+
+// handle_links_node sends 'noconnection' exit signals to the local processes
+// linked to processes on the node which went down
+func (n *Node) handle_links_node(node etf.Atom) {
+	type link struct {
+		remote etf.Pid
+		local  etf.Pid
+	}
+	var broken []link
+
+	n.lock.Lock()
+	for pid, linked := range n.links {
+		if pid.Node != node {
+			continue
+		}
+		for _, p := range linked {
+			broken = append(broken, link{pid, p})
+			if l := removePid(n.links[p], pid); len(l) > 0 {
+				n.links[p] = l
+			} else {
+				delete(n.links, p)
+			}
+		}
+		delete(n.links, pid)
+	}
+	n.lock.Unlock()
+
+	for _, l := range broken {
+		n.exitSignal(l.remote, l.local, etf.Atom("noconnection"), true)
 	}
 }
 
 func (n *Node) MakeRef() (ref etf.Ref) {
 	ref.Node = etf.Atom(n.FullName)
-	ref.Creation = 1
+	ref.Creation = n.creation()
 
-	nt := time.Now().UnixNano()
-	id1 := uint32(uint64(nt) & ((2 << 17) - 1))
-	id2 := uint32(uint64(nt) >> 46)
-	ref.Id = []uint32{id1, id2, 0}
+	// like OTP does: 18 bits in the first word, the rest in the next ones
+	id := atomic.AddUint64(&n.refID, 1)
+	ref.Id = []uint32{uint32(id & (1<<18 - 1)), uint32(id >> 18), uint32(id >> 50)}
 
 	return
 }
 
-func connect(n *Node, to etf.Atom) error {
+// getConnection returns connection to the node. Makes a new one if it doesn't exist
+func (n *Node) getConnection(ctx context.Context, to etf.Atom) (conn nodeConn, err error) {
+	var exists bool
 
-	var port int
-	var err error
+	n.lock.Lock()
+	conn, exists = n.connections[to]
+	n.lock.Unlock()
+	if exists {
+		return
+	}
 
-	if port, err = n.ResolvePort(string(to)); port < 0 {
-		return fmt.Errorf("Can't resolve port: %s", err)
+	lib.Log("Create new connection (%s)", to)
+	if err = connect(ctx, n, to); err != nil {
+		return
 	}
-	ns := strings.Split(string(to), "@")
 
-	c, err := net.Dial("tcp", net.JoinHostPort(ns[1], strconv.Itoa(int(port))))
+	n.lock.Lock()
+	conn, exists = n.connections[to]
+	n.lock.Unlock()
+	if !exists {
+		err = fmt.Errorf("Can't connect to %s", to)
+	}
+	return
+}
+
+// connect makes connection to the node. Concurrent connects to the same node
+// share the same attempt. Caller stops waiting for it once the context is
+// done, but the attempt itself is aborted only if the node is stopped
+func connect(ctx context.Context, n *Node, to etf.Atom) error {
+	n.lock.Lock()
+	if _, exists := n.connections[to]; exists {
+		n.lock.Unlock()
+		return nil
+	}
+	hs, exists := n.handshakes[to]
+	if !exists {
+		hs = &handshake{
+			connected: make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+		n.handshakes[to] = hs
+		go n.dial(to, hs)
+	}
+	n.lock.Unlock()
+
+	// caller abandons its own wait only. The attempt goes on for the others
+	select {
+	case <-hs.done:
+		return hs.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dial makes the connection attempt shared by the callers of connect. It
+// runs under the node context and is limited by setupTimeout
+func (n *Node) dial(to etf.Atom, hs *handshake) (err error) {
+	ctx, cancel := context.WithTimeout(n.context, setupTimeout)
+	defer cancel()
+	connected := hs.connected
+
+	defer func() {
+		n.lock.Lock()
+		delete(n.handshakes, to)
+		hs.err = err
+		close(hs.done)
+		n.lock.Unlock()
+	}()
+
+	address, err := n.opts.Transport.Resolve(ctx, string(to), n.opts)
 	if err != nil {
-		lib.Log("Error calling net.Dial : %s", err.Error())
 		return err
 	}
 
-	if tcp, ok := c.(*net.TCPConn); ok {
-		tcp.SetKeepAlive(true)
+	c, err := n.opts.Transport.Dial(ctx, string(to), address)
+	if err != nil {
+		return err
 	}
 
-	n.run(c, true)
+	n.lock.Lock()
+	aborted := hs.aborted
+	hs.conn = c
+	n.lock.Unlock()
+	if aborted {
+		c.Close()
+		err = dist.ErrStatusNok
+	} else {
+		err = n.run(ctx, c, to)
+	}
 
-	return nil
+	n.lock.Lock()
+	aborted = hs.aborted
+	n.lock.Unlock()
+	if err == dist.ErrStatusAlive {
+		// remote node has connected to this one in the meantime
+		return nil
+	}
+	if err == nil || (err != dist.ErrStatusNok && !aborted) {
+		return
+	}
+
+	// simultaneous connect. Connection is made by the remote node
+	lib.Log("Simultaneous connect to %s. Waiting for the incoming connection", to)
+	timer := time.NewTimer(simultaneousTimeout)
+	defer timer.Stop()
+	select {
+	case <-connected:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("Can't connect to %s: %s", to, err)
+	case <-n.context.Done():
+		return n.context.Err()
+	}
+}
+
+// handshakeStatus returns the status of the handshake with the node which
+// has connected to this node
+func (n *Node) handshakeStatus(name string) string {
+	n.lock.Lock()
+	if _, exists := n.connections[etf.Atom(name)]; exists {
+		n.lock.Unlock()
+		return dist.StatusAlive
+	}
+	hs, exists := n.handshakes[etf.Atom(name)]
+	if !exists {
+		n.lock.Unlock()
+		return dist.StatusOk
+	}
+	// simultaneous connect. Attempt of the node with the greater name wins
+	if n.FullName > name {
+		n.lock.Unlock()
+		return dist.StatusNok
+	}
+	hs.aborted = true
+	c := hs.conn
+	n.lock.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+	return dist.StatusOkSimultaneous
+}
+
+func isRefEqual(a, b etf.Ref) bool {
+	if a.Node != b.Node || a.Creation != b.Creation || len(a.Id) != len(b.Id) {
+		return false
+	}
+	for i := range a.Id {
+		if a.Id[i] != b.Id[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func removePid(pids []etf.Pid, pid etf.Pid) []etf.Pid {
@@ -19,7 +19,9 @@ type atomCacheRef struct {
 
 type Context struct {
 	atomCache             [2048]*string
-	currentCache          []*string
+	currentCache          DistRefs
+	writeCache            *writeAtomCache
+	distWrite             bool // atoms are written as cache refs
 	ConvertBinaryToString bool
 	ConvertAtomsToBinary  bool
 }
@@ -34,18 +36,18 @@ type Pid struct {
 	Node     Atom
 	Id       uint32
 	Serial   uint32
-	Creation byte
+	Creation uint32
 }
 
 type Port struct {
 	Node     Atom
-	Id       uint32
-	Creation byte
+	Id       uint64
+	Creation uint32
 }
 
 type Ref struct {
 	Node     Atom
-	Creation byte
+	Creation uint32
 	Id       []uint32
 }
 
@@ -105,7 +107,10 @@ const (
 	ettNewCache      = byte(78)
 	ettNewFloat      = byte(70)
 	ettNewFun        = byte(112)
+	ettNewPid        = byte(88)
+	ettNewPort       = byte(89)
 	ettNewRef        = byte(114)
+	ettNewerRef      = byte(90)
 	ettNil           = byte(106)
 	ettPid           = byte(103)
 	ettPort          = byte(102)
@@ -117,6 +122,7 @@ const (
 	ettSmallTuple    = byte(104)
 	ettString        = byte(107)
 	ettMap           = byte(116)
+	ettV4Port        = byte(120)
 )
 
 const (
@@ -127,6 +133,10 @@ const (
 const (
 	// Erlang distribution header
 	EtDist = byte('D')
+	// Distribution header of the first fragment of the message
+	EtDistFragmentHeader = byte('E')
+	// Distribution header of the following fragments of the message
+	EtDistFragment = byte('F')
 )
 
 var tagNames = map[byte]string{
@@ -146,7 +156,10 @@ var tagNames = map[byte]string{
 	ettNewCache:      "NEW_CACHE_EXT",
 	ettNewFloat:      "NEW_FLOAT_EXT",
 	ettNewFun:        "NEW_FUN_EXT",
+	ettNewPid:        "NEW_PID_EXT",
+	ettNewPort:       "NEW_PORT_EXT",
 	ettNewRef:        "NEW_REFERENCE_EXT",
+	ettNewerRef:      "NEWER_REFERENCE_EXT",
 	ettNil:           "NIL_EXT",
 	ettPid:           "PID_EXT",
 	ettPort:          "PORT_EXT",
@@ -157,6 +170,7 @@ var tagNames = map[byte]string{
 	ettSmallInteger:  "SMALL_INTEGER_EXT",
 	ettSmallTuple:    "SMALL_TUPLE_EXT",
 	ettString:        "STRING_EXT",
+	ettV4Port:        "V4_PORT_EXT",
 }
 
 
@@ -32,6 +32,19 @@ func (c *Context) ReadDist(r io.Reader) (err error) {
 		return
 	}
 
+	c.currentCache, err = c.ReadDistRefs(r)
+	return
+}
+
+// DistRefs are the atoms referenced by the distribution header of the
+// message. Terms of the message refer to them by ATOM_CACHE_REF
+type DistRefs []*string
+
+// ReadDistRefs reads the distribution header which follows the tag ('D' or
+// 'E' of the first fragment), updates the atom cache and returns the atoms
+// referenced by the message
+func (c *Context) ReadDistRefs(r io.Reader) (refs DistRefs, err error) {
+	b := make([]byte, 1)
 	_, err = io.ReadFull(r, b)
 	if err != nil {
 		return
@@ -109,7 +122,7 @@ func (c *Context) ReadDist(r io.Reader) (err error) {
 			i++
 		}
 
-		c.currentCache = currentAtomCache
+		refs = currentAtomCache
 	}
 	return
 }
@@ -127,6 +140,13 @@ func (c *Context) NewDecoder(r io.Reader) *Decoder {
 	}
 }
 
+// ReadWithRefs reads the term like Read does. Atom cache refs are resolved
+// by the given refs of the message
+func (c *Context) ReadWithRefs(r io.Reader, refs DistRefs) (term Term, err error) {
+	c.currentCache = refs
+	return c.Read(r)
+}
+
 func (c *Context) Read(r io.Reader) (term Term, err error) {
 	reader := &Decoder{
 		context: c,
@@ -270,11 +290,27 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 		pid.Node = node.(Atom)
 		pid.Id = be.Uint32(b[:4])
 		pid.Serial = be.Uint32(b[4:8])
-		pid.Creation = b[8]
+		pid.Creation = uint32(b[8])
+		term = pid
+
+	case ettNewPid:
+		// $XA…IIIISSSSCCCC
+		var node interface{}
+		var pid Pid
+		b = make([]byte, 12)
+		if node, err = d.NextTerm(); err != nil {
+			return
+		} else if _, err = io.ReadFull(d.r, b); err != nil {
+			return
+		}
+		pid.Node = node.(Atom)
+		pid.Id = be.Uint32(b[:4])
+		pid.Serial = be.Uint32(b[4:8])
+		pid.Creation = be.Uint32(b[8:12])
 		term = pid
 
-	case ettNewRef:
-		// $rLL…
+	case ettNewRef, ettNewerRef:
+		// $rLL…C or $ZLL…CCCC
 		var ref Ref
 		var node interface{}
 		var nid uint16
@@ -282,7 +318,15 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 			return
 		} else if node, err = d.NextTerm(); err != nil {
 			return
-		} else if ref.Creation, err = d.readByte(); err != nil {
+		}
+		if etype == ettNewRef {
+			var creation byte
+			creation, err = d.readByte()
+			ref.Creation = uint32(creation)
+		} else {
+			ref.Creation, err = d.ruint32()
+		}
+		if err != nil {
 			return
 		}
 		ref.Node = node.(Atom)
@@ -308,7 +352,7 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 		} else if _, err = io.ReadFull(d.r, b); err != nil {
 			return
 		}
-		ref.Creation = b[0]
+		ref.Creation = uint32(b[0])
 		term = ref
 
 	case ettSmallTuple:
@@ -398,18 +442,24 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 		term = b
 
 	case ettExport:
-		// $qM…F…A
-		var m, f interface{}
-		var a uint8
+		// $qM…F…A (arity is SMALL_INTEGER_EXT)
+		var m, f, a interface{}
 		if m, err = d.NextTerm(); err != nil {
 			break
 		} else if f, err = d.NextTerm(); err != nil {
 			break
-		} else if a, err = d.readByte(); err != nil {
+		} else if a, err = d.NextTerm(); err != nil {
+			break
+		}
+		module, ok1 := m.(Atom)
+		function, ok2 := f.(Atom)
+		arity, ok3 := a.(int)
+		if !ok1 || !ok2 || !ok3 || arity > 255 {
+			err = fmt.Errorf("malformed EXPORT_EXT")
 			break
 		}
 
-		term = Export{m.(Atom), f.(Atom), a}
+		term = Export{module, function, byte(arity)}
 
 	case ettNewFun:
 		// $pSSSSAUUUUUUUUUUUUUUUUIIIIFFFFM…i…u…P…[V…]
@@ -459,13 +509,34 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 		f.Pid = pid.(Pid)
 		term = f
 
-	case ettPort:
-		// $fA…IIIIC
+	case ettPort, ettNewPort, ettV4Port:
+		// $fA…IIIIC, $YA…IIIICCCC or $xA…IIIIIIIICCCC
 		var p Port
-		a, _ := d.NextTerm()
-		p.Node = a.(Atom)
-		p.Id, _ = d.ruint32()
-		p.Creation, err = d.readByte()
+		var node interface{}
+		if node, err = d.NextTerm(); err != nil {
+			return
+		}
+		p.Node = node.(Atom)
+		if etype == ettV4Port {
+			b = make([]byte, 8)
+			if _, err = io.ReadFull(d.r, b); err != nil {
+				return
+			}
+			p.Id = be.Uint64(b)
+		} else {
+			var id uint32
+			if id, err = d.ruint32(); err != nil {
+				return
+			}
+			p.Id = uint64(id)
+		}
+		if etype == ettPort {
+			var creation byte
+			creation, err = d.readByte()
+			p.Creation = uint32(creation)
+		} else {
+			p.Creation, err = d.ruint32()
+		}
 		term = p
 
 	case ettCacheRef:
@@ -473,6 +544,10 @@ func (d *Decoder) NextTerm() (term Term, err error) {
 		if _, err = io.ReadFull(d.r, b); err != nil {
 			break
 		}
+		if int(b[0]) >= len(d.context.currentCache) || d.context.currentCache[b[0]] == nil {
+			err = fmt.Errorf("read: unknown atom cache ref %d", b[0])
+			break
+		}
 		term = Atom(*d.context.currentCache[b[0]])
 
 	default:
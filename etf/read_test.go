@@ -355,6 +355,23 @@ func TestReadPid(t *testing.T) {
 	} else if v != exp {
 		t.Errorf("expected %v, got %v", exp, v)
 	}
+
+	// NEW_PID_EXT (lol@localhost, OTP 23+)
+	in = bytes.NewBuffer([]byte{
+		88, 100, 0, 13, 108, 111,
+		108, 64, 108, 111, 99, 97,
+		108, 104, 111, 115, 116, 0,
+		0, 0, 38, 0, 0, 0, 0, 95,
+		16, 32, 48,
+	})
+	exp = Pid{Atom("lol@localhost"), 38, 0, 0x5f102030}
+	if v, err := c.Read(in); err != nil {
+		t.Error(err)
+	} else if l := in.Len(); l != 0 {
+		t.Errorf("buffer len %d", l)
+	} else if v != exp {
+		t.Errorf("expected %v, got %v", exp, v)
+	}
 }
 
 func TestReadString(t *testing.T) {
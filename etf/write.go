@@ -14,12 +14,176 @@ type ErrUnknownType struct {
 	t reflect.Type
 }
 
-func (c *Context) WriteDist(w io.Writer, _ []Term) (err error) {
-	// TODO: now it is just stub dist header, add cache functionality
-	_, err = w.Write([]byte{EtDist, 0})
+const (
+	// atomCacheSize is the number of the atom cache entries (8 segments
+	// by 256 entries)
+	atomCacheSize = 2048
+	// maxCacheRefs is the maximum number of the atom cache refs in the
+	// distribution header
+	maxCacheRefs = 255
+)
+
+// writeAtomCache is the state of the atom cache of the remote node. It's
+// updated by the distribution headers sent to that node
+type writeAtomCache struct {
+	index map[Atom]uint16
+	atoms [atomCacheSize]Atom
+	// number of the message which has referenced the entry last time and
+	// the index of the ref in that message
+	used   [atomCacheSize]uint32
+	refIdx [atomCacheSize]uint8
+	next   uint16
+	msg    uint32
+
+	// refs of the message being written
+	refs      []writeCacheRef
+	long      bool
+	buf       bytes.Buffer
+	headerBuf []byte
+}
+
+type writeCacheRef struct {
+	atom  Atom
+	idx   uint16
+	isNew bool
+}
+
+func newWriteAtomCache() *writeAtomCache {
+	return &writeAtomCache{
+		index: make(map[Atom]uint16),
+	}
+}
+
+// begin starts the new message
+func (wc *writeAtomCache) begin() {
+	wc.msg++
+	wc.refs = wc.refs[:0]
+	wc.long = false
+}
+
+// ref returns the index of the atom in the refs of the current message.
+// Returns false if the atom can't be cached
+func (wc *writeAtomCache) ref(atom Atom) (uint8, bool) {
+	idx, exists := wc.index[atom]
+	if exists && wc.used[idx] == wc.msg {
+		return wc.refIdx[idx], true
+	}
+	if len(wc.refs) == maxCacheRefs || len(atom) > math.MaxUint16 {
+		return 0, false
+	}
+
+	if !exists {
+		// take the next entry which isn't referenced by the current message
+		for {
+			idx = wc.next
+			wc.next = (wc.next + 1) % atomCacheSize
+			if wc.used[idx] != wc.msg {
+				break
+			}
+		}
+		if old, exists := wc.index[wc.atoms[idx]]; exists && old == idx {
+			delete(wc.index, wc.atoms[idx])
+		}
+		wc.atoms[idx] = atom
+		wc.index[atom] = idx
+		if len(atom) > math.MaxUint8 {
+			wc.long = true
+		}
+	}
+	r := uint8(len(wc.refs))
+	wc.used[idx] = wc.msg
+	wc.refIdx[idx] = r
+	wc.refs = append(wc.refs, writeCacheRef{atom: atom, idx: idx, isNew: !exists})
+	return r, true
+}
+
+// header returns the distribution header of the current message
+func (wc *writeAtomCache) header() []byte {
+	n := len(wc.refs)
+	header := append(wc.headerBuf[:0], EtDist, byte(n))
+	if n == 0 {
+		wc.headerBuf = header
+		return header
+	}
+
+	// 4 bits per ref (NewCacheEntryFlag and SegmentIndex) and 4 bits
+	// of the flags of the whole header (LongAtoms)
+	for i := 0; i < n/2+1; i++ {
+		header = append(header, 0)
+	}
+	flags := header[2:]
+	for i, ref := range wc.refs {
+		v := byte(ref.idx>>8) & 0x07
+		if ref.isNew {
+			v |= 0x08
+		}
+		flags[i/2] |= v << (4 * uint(i&1))
+	}
+	if wc.long {
+		flags[n/2] |= 0x01 << (4 * uint(n&1))
+	}
+
+	for _, ref := range wc.refs {
+		header = append(header, byte(ref.idx))
+		if !ref.isNew {
+			continue
+		}
+		size := len(ref.atom)
+		if wc.long {
+			header = append(header, byte(size>>8), byte(size))
+		} else {
+			header = append(header, byte(size))
+		}
+		header = append(header, ref.atom...)
+	}
+	wc.headerBuf = header
+	return header
+}
+
+// WriteDist writes the distribution header (DIST_HDR_ATOM_CACHE) followed
+// by the terms (control message and payload). Atoms are written as atom
+// cache refs. Cache of the remote node is tracked by the context, so it
+// must be used for the only connection
+func (c *Context) WriteDist(w io.Writer, terms []Term) (err error) {
+	header, payload, err := c.EncodeDist(terms)
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+	_, err = w.Write(payload)
 	return
 }
 
+// EncodeDist encodes the terms like WriteDist does. Distribution header
+// (starting with 'D' tag) and the encoded terms are returned separately.
+// They are valid until the next call
+func (c *Context) EncodeDist(terms []Term) (header, payload []byte, err error) {
+	if c.writeCache == nil {
+		c.writeCache = newWriteAtomCache()
+	}
+	c.writeCache.begin()
+
+	buf := &c.writeCache.buf
+	buf.Reset()
+	c.distWrite = true
+	for _, t := range terms {
+		if err = c.Write(buf, t); err != nil {
+			break
+		}
+	}
+	c.distWrite = false
+
+	if err != nil {
+		// new entries haven't been sent. Start with the empty cache
+		c.writeCache = nil
+		return
+	}
+
+	return c.writeCache.header(), buf.Bytes(), nil
+}
+
 func (c *Context) Write(w io.Writer, term interface{}) (err error) {
 	switch v := term.(type) {
 	case bool:
@@ -50,6 +214,8 @@ func (c *Context) Write(w io.Writer, term interface{}) (err error) {
 		err = c.writeTuple(w, v)
 	case Ref:
 		err = c.writeRef(w, v)
+	case Export:
+		err = c.writeExport(w, v)
 	default:
 		rv := reflect.ValueOf(v)
 		switch rv.Kind() {
@@ -75,6 +241,13 @@ func (e *ErrUnknownType) Error() string {
 }
 
 func (c *Context) writeAtom(w io.Writer, atom Atom) (err error) {
+	if c.distWrite {
+		if r, ok := c.writeCache.ref(atom); ok {
+			_, err = w.Write([]byte{ettCacheRef, r})
+			return
+		}
+	}
+
 	switch size := len(atom); {
 	// case size <= math.MaxUint8:
 	// 	// $sL…
@@ -210,20 +383,48 @@ func (c *Context) writeUint(w io.Writer, x uint64) (err error) {
 	return
 }
 
+// bigCreation returns true if the creation doesn't fit into old (2-bit)
+// format of pids, ports and references
+func bigCreation(creation uint32) bool {
+	return creation > 3
+}
+
 func (c *Context) writePid(w io.Writer, p Pid) (err error) {
-	if _, err = w.Write([]byte{ettPid}); err != nil {
+	// NEW_PID_EXT is used for 32-bit creation (OTP 23+) and for the ids
+	// which don't fit into PID_EXT
+	newPid := bigCreation(p.Creation) || p.Id > 0x7fff
+	tag := ettPid
+	if newPid {
+		tag = ettNewPid
+	}
+	if _, err = w.Write([]byte{tag}); err != nil {
 		return
 	} else if err = c.writeAtom(w, p.Node); err != nil {
 		return
 	}
 
+	if newPid {
+		_, err = w.Write([]byte{
+			byte(p.Id >> 24), byte(p.Id >> 16), byte(p.Id >> 8), byte(p.Id),
+			byte(p.Serial >> 24),
+			byte(p.Serial >> 16),
+			byte(p.Serial >> 8),
+			byte(p.Serial),
+			byte(p.Creation >> 24),
+			byte(p.Creation >> 16),
+			byte(p.Creation >> 8),
+			byte(p.Creation),
+		})
+		return
+	}
+
 	_, err = w.Write([]byte{
 		0, 0, byte(p.Id >> 8), byte(p.Id),
 		byte(p.Serial >> 24),
 		byte(p.Serial >> 16),
 		byte(p.Serial >> 8),
 		byte(p.Serial),
-		p.Creation,
+		byte(p.Creation),
 	})
 
 	return
@@ -359,14 +560,27 @@ func (c *Context) writeMap(w io.Writer, rv reflect.Value) (err error) {
 
 func (c *Context) writeRef(w io.Writer, ref Ref) (err error) {
 	n := len(ref.Id)
-	_, err = w.Write([]byte{ettNewRef, byte(n >> 8), byte(n)})
+	tag := ettNewRef
+	if bigCreation(ref.Creation) {
+		tag = ettNewerRef
+	}
+	_, err = w.Write([]byte{tag, byte(n >> 8), byte(n)})
 	if err != nil {
 		return
 	}
 	if err = c.writeAtom(w, ref.Node); err != nil {
 		return
 	}
-	if _, err = w.Write([]byte{ref.Creation}); err != nil {
+	creation := []byte{byte(ref.Creation)}
+	if tag == ettNewerRef {
+		creation = []byte{
+			byte(ref.Creation >> 24),
+			byte(ref.Creation >> 16),
+			byte(ref.Creation >> 8),
+			byte(ref.Creation),
+		}
+	}
+	if _, err = w.Write(creation); err != nil {
 		return
 	}
 	for _, v := range ref.Id {
@@ -384,6 +598,20 @@ func (c *Context) writeRef(w io.Writer, ref Ref) (err error) {
 	return
 }
 
+func (c *Context) writeExport(w io.Writer, export Export) (err error) {
+	if _, err = w.Write([]byte{ettExport}); err != nil {
+		return
+	}
+	if err = c.writeAtom(w, export.Module); err != nil {
+		return
+	}
+	if err = c.writeAtom(w, export.Function); err != nil {
+		return
+	}
+	_, err = w.Write([]byte{ettSmallInteger, export.Arity})
+	return
+}
+
 func (c *Context) writeTuple(w io.Writer, tuple Tuple) (err error) {
 	n := len(tuple)
 	if n <= math.MaxUint8 {
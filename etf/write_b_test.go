@@ -191,7 +191,7 @@ func BenchmarkWritePid(b *testing.B) {
 			Atom(b),
 			uint32(rand.Intn(65536)),
 			uint32(rand.Intn(256)),
-			byte(rand.Intn(16)),
+			uint32(rand.Intn(16)),
 		}
 	}
 
@@ -228,3 +228,60 @@ func BenchmarkWriteString(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkDistMessage() []Term {
+	from := Pid{Atom("gonode@localhost"), 1024, 1, 1}
+	to := Pid{Atom("erlnode@localhost"), 512, 1, 1}
+	ref := Ref{Atom("gonode@localhost"), 1, []uint32{1, 2, 3}}
+	ctl := Tuple{6, from, Atom(""), Atom("example_server")}
+	message := Tuple{
+		Atom("$gen_call"),
+		Tuple{from, ref},
+		Tuple{Atom("call"), Atom("example_module"), Atom("example_function"), List{to, Atom("ok")}},
+	}
+	return []Term{ctl, message}
+}
+
+func BenchmarkWriteDistAtomCache(b *testing.B) {
+	b.StopTimer()
+	c := new(Context)
+	terms := benchmarkDistMessage()
+	w := new(bytes.Buffer)
+	c.WriteDist(w, terms)
+	w.Reset()
+	c.WriteDist(w, terms)
+	b.Logf("message size: %d bytes", w.Len())
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		if err := c.WriteDist(w, terms); err != nil {
+			b.Fatal(terms, err)
+		}
+	}
+}
+
+// BenchmarkWriteDistNoCache writes the same message with the empty dist
+// header (without atom cache)
+func BenchmarkWriteDistNoCache(b *testing.B) {
+	b.StopTimer()
+	c := new(Context)
+	terms := benchmarkDistMessage()
+	w := new(bytes.Buffer)
+	write := func() {
+		w.Reset()
+		w.Write([]byte{EtDist, 0})
+		for _, t := range terms {
+			if err := c.Write(w, t); err != nil {
+				b.Fatal(t, err)
+			}
+		}
+	}
+	write()
+	b.Logf("message size: %d bytes", w.Len())
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		write()
+	}
+}
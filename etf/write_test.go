@@ -2,6 +2,7 @@ package etf
 
 import (
 	"bytes"
+	"fmt"
 	"math"
 	"math/big"
 	"reflect"
@@ -172,6 +173,27 @@ func TestWritePid(t *testing.T) {
 
 	test(Pid{Atom("omg@lol"), 38, 0, 3})
 	test(Pid{Atom("self@localhost"), 32, 1, 9})
+	test(Pid{Atom("self@localhost"), 0x12345, 1, 0x7aabbccd})
+}
+
+func TestWriteExport(t *testing.T) {
+	c := new(Context)
+	in := Export{Atom("global"), Atom("random_exit_name"), 3}
+	w := new(bytes.Buffer)
+	if err := c.Write(w, in); err != nil {
+		t.Fatal(err)
+	}
+	// arity is SMALL_INTEGER_EXT
+	if b := w.Bytes(); b[len(b)-2] != ettSmallInteger || b[len(b)-1] != 3 {
+		t.Fatalf("wrong encoding %v", b)
+	}
+	if v, err := c.Read(w); err != nil {
+		t.Fatal(err)
+	} else if l := w.Len(); l != 0 {
+		t.Fatalf("buffer len %d", l)
+	} else if v != in {
+		t.Fatalf("expected %v, got %v", in, v)
+	}
 }
 
 func TestWriteString(t *testing.T) {
@@ -243,3 +265,77 @@ func TestWriteTerm(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteDist(t *testing.T) {
+	writer := new(Context)
+	reader := new(Context)
+
+	pid := Pid{Node: Atom("node@localhost"), Id: 32, Serial: 1, Creation: 1}
+	long := Atom(bytes.Repeat([]byte{'a'}, math.MaxUint8+1))
+
+	test := func(in []Term, newEntries int) {
+		w := new(bytes.Buffer)
+		if err := writer.WriteDist(w, in); err != nil {
+			t.Fatal(in, err)
+		}
+
+		header := w.Bytes()
+		if header[0] != EtDist {
+			t.Fatalf("not dist header: %v", header)
+		}
+		n := 0
+		for i, ref := range writer.writeCache.refs {
+			if ref.isNew {
+				n++
+			}
+			// new entry flag has to be encoded in the flags of the header
+			v := (header[2+i/2] >> (4 * uint(i&1))) & 0x0F
+			if ref.isNew != (v&0x08 == 0x08) {
+				t.Fatalf("wrong flags of the ref %d: %v", i, header)
+			}
+		}
+		if n != newEntries {
+			t.Fatalf("expected %d new cache entries, got %d", newEntries, n)
+		}
+
+		if err := reader.ReadDist(w); err != nil {
+			t.Fatal(in, err)
+		}
+		for _, term := range in {
+			v, err := reader.Read(w)
+			if err != nil {
+				t.Fatal(term, err)
+			}
+			if !reflect.DeepEqual(v, term) {
+				t.Fatalf("expected %#v, got %#v", term, v)
+			}
+		}
+		if l := w.Len(); l != 0 {
+			t.Fatalf("%v: buffer len %d", in, l)
+		}
+	}
+
+	ctl := Term(Tuple{6, pid, Atom(""), Atom("rex")})
+	message := Term(Tuple{Atom("$gen_call"), Tuple{pid, Atom("ok")}, Atom("call")})
+	test([]Term{ctl, message}, 6)
+	// the same atoms are referenced by the existing cache entries
+	test([]Term{ctl, message}, 0)
+	test([]Term{ctl, Tuple{Atom("$gen_call"), Atom("cast")}}, 1)
+	// long atoms
+	test([]Term{ctl, Tuple{long, Atom("call")}}, 1)
+
+	// there are 255 refs at most. The rest of atoms are written as is
+	atoms := make(Tuple, 300)
+	for i := range atoms {
+		atoms[i] = Atom(fmt.Sprintf("atom%d", i))
+	}
+	test([]Term{atoms}, 255)
+
+	// all the entries of the cache are reused
+	for i := 0; i < 20; i++ {
+		for j := range atoms {
+			atoms[j] = Atom(fmt.Sprintf("atom%d_%d", i, j))
+		}
+		test([]Term{atoms}, 255)
+	}
+}
@@ -146,7 +146,7 @@ func (gs *goGenServ) HandleInfo(message *etf.Term, state interface{}) (code int,
 }
 
 // Terminate called when process died
-func (gs *goGenServ) Terminate(reason int, state interface{}) {
+func (gs *goGenServ) Terminate(reason etf.Term, state interface{}) {
 	fmt.Printf("Terminate: %#v\n", reason)
 }
 
@@ -188,13 +188,18 @@ func main() {
 	}
 
 	// Initialize new node with given name, cookie, listening port range and epmd port
-	n := ergonode.Create(NodeName, Cookie, uint16(ListenRangeBegin), uint16(ListenRangeEnd), uint16(ListenEPMD))
-
-	// listen from ListenRangeBegin ... 65000
-	// n := ergonode.Create(NodeName, Cookie, uint16(ListenRangeBegin))
+	opts := ergonode.NodeOptions{
+		ListenRangeBegin: uint16(ListenRangeBegin),
+		ListenRangeEnd:   uint16(ListenRangeEnd),
+		EPMDPort:         uint16(ListenEPMD),
+	}
+	n, err := ergonode.Create(NodeName, Cookie, opts)
+	if err != nil {
+		panic(err)
+	}
 
-	// use default listen port range: 15000...65000
-	//n := ergonode.Create(NodeName, Cookie)
+	// use default listen port range: 15000...65000 and EPMD port 4369
+	// n, err := ergonode.Create(NodeName, Cookie, ergonode.NodeOptions{})
 
 	// Create channel to receive message when main process should be stopped
 	completeChan := make(chan bool)
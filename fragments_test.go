@@ -0,0 +1,74 @@
+package ergonode
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestFragmentedMessages(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{FragmentSize: 100})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+
+	// concurrent calls make the fragments of the different messages
+	// interleave
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			message := etf.Term(etf.Tuple{etf.Atom("big"), i, strings.Repeat("a", 1000*(i+1))})
+			reply, err := gs1.Call(pid2, &message)
+			if err == nil && !reflect.DeepEqual(*reply, message) {
+				err = fmt.Errorf("expected %#v, got %#v", message, *reply)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// small messages aren't split
+	message := etf.Term(etf.Atom("small"))
+	reply, err := gs1.Call(pid2, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reply != message {
+		t.Fatalf("expected %#v, got %#v", message, *reply)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// the reassembled fragments are limited as well as the single frames
+	for _, size := range []int{0, 500} {
+		opts := NodeOptions{Transport: NewPipeTransport(), FragmentSize: size}
+		node1 := newPipeNode(t, "node1@localhost", "cookie", opts)
+		opts.MaxMessageSize = 1000
+		node2 := newPipeNode(t, "node2@localhost", "cookie", opts)
+
+		gs1 := new(testEchoServer)
+		node1.Spawn(gs1)
+		pid2 := node2.Spawn(new(testEchoServer))
+
+		message := etf.Term(etf.Atom("small"))
+		if _, err := gs1.Call(pid2, &message); err != nil {
+			t.Fatal(err)
+		}
+		message = etf.Term(strings.Repeat("a", 2000))
+		if _, err := gs1.Call(pid2, &message); err == nil {
+			t.Fatalf("message bigger than the limit has been delivered (fragment size %d)", size)
+		}
+		stopNodes([]*Node{node1, node2})
+	}
+}
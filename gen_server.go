@@ -1,7 +1,9 @@
 package ergonode
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -24,138 +26,205 @@ type GenServerInt interface {
 	// HandleInfo -> (0, state) - noreply
 	//		         (-1, state) - normal stop (-2, -3 .... custom reasons to stop)
 	HandleInfo(message *etf.Term, state interface{}) (int, interface{})
-	Terminate(reason int, state interface{})
+	// Terminate(reason, state) is called when the process stops: callback
+	// returned stop code, Stop was called or exit signal was received while
+	// trapping exits. Reason is 'normal', 'shutdown', {shutdown, X} or any
+	// custom term
+	Terminate(reason etf.Term, state interface{})
 
 	// Making outgoing request
 	Call(to interface{}, message *etf.Term, options ...interface{}) (reply *etf.Term, err error)
+	CallContext(ctx context.Context, to interface{}, message *etf.Term) (reply *etf.Term, err error)
 	Cast(to interface{}, message *etf.Term) (err error)
 
 	// Monitors
-	Monitor(to etf.Pid)
+	Monitor(to interface{}) etf.Ref
+	Demonitor(ref etf.Ref) bool
 	MonitorNode(to etf.Atom, flag bool)
+
+	// Links
+	Link(to etf.Pid)
+	Unlink(to etf.Pid)
+
+	// Exits
+	Stop(reason etf.Term)
+	Exit(to etf.Pid, reason etf.Term)
+	SetTrapExit(flag bool)
 }
 
 // GenServer is implementation of GenServerInt interface
 type GenServer struct {
-	Node    *Node   // current node of process
-	Self    etf.Pid // Pid of process
-	state   interface{}
-	lock    sync.Mutex
-	chreply chan *etf.Tuple
+	Node     *Node   // current node of process
+	Self     etf.Pid // Pid of process
+	state    interface{}
+	lock     sync.Mutex
+	stop     chan etf.Term
+	trapExit bool
+	context  context.Context
+
+	// outgoing calls waiting for the reply (keyed by the monitor reference)
+	calls map[string]chan etf.Tuple
+	// DOWN messages of the finished calls to be dropped
+	flushDown map[string]bool
 }
 
 // Options returns map of default process-related options
 func (gs *GenServer) Options() map[string]interface{} {
 	return map[string]interface{}{
-		"chan-size": 100, // size of channel for regular messages
+		"mailbox-size":   0,                 // max number of messages in the mailbox (0 - unbounded)
+		"mailbox-policy": MailboxDropNewest, // what to do once the bounded mailbox is full
+		"trap-exit":      false,             // receive exit signals as {'EXIT', From, Reason} messages
 	}
 }
 
 // ProcessLoop executes during whole time of process life.
-// It receives incoming messages from channels and handle it using methods of behaviour implementation
+// It receives exit signals and puts the trapped ones into the mailbox.
+// Messages from the mailbox are handled one by one (strictly in order) by the
+// methods of behaviour implementation on a separate goroutine
 func (gs *GenServer) ProcessLoop(pcs procChannels, pd Process, args ...interface{}) {
-	state := pd.(GenServerInt).Init(args...)
-	gs.state = state
-	pcs.init <- true
-	var chstop chan int
-	chstop = make(chan int)
+	var exitReason etf.Term = etf.Atom("normal")
+	initialized := false
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("GenServerInt recovered: %#v", r)
+			exitReason = etf.Tuple{etf.Atom("panic"), fmt.Sprint(r)}
 		}
+		if !initialized {
+			// Init has failed. Do not block Spawn
+			pcs.init <- false
+		}
+		gs.Node.processExited(gs.Self, exitReason)
 	}()
+
+	options := pd.Options()
+	gs.stop = make(chan etf.Term, 1)
+	gs.context = pcs.context
+	gs.trapExit, _ = options["trap-exit"].(bool)
+	// replies on the calls bypass the mailbox. Handler waiting for the
+	// reply is blocked, so it can't take them from there
+	pcs.mailbox.setFilter(gs.routeCallReply)
+	state := pd.(GenServerInt).Init(args...)
+	gs.state = state
+	initialized = true
+	pcs.init <- true
+
+	stopped := make(chan etf.Term)
+	killed := make(chan bool)
+	go gs.handleLoop(pd, pcs.mailbox, stopped, killed)
+
+	ctxDone := pcs.context.Done()
 	for {
-		var message etf.Term
-		var fromPid etf.Pid
 		select {
-		case reason := <-chstop:
-			pd.(GenServerInt).Terminate(reason, gs.state)
-		case msg := <-pcs.in:
-			message = msg
-		case msgFrom := <-pcs.inFrom:
-			message = msgFrom[1]
-			fromPid = msgFrom[0].(etf.Pid)
-
-		}
-		lib.Log("[%#v]. Message from %#v\n", gs.Self, fromPid)
-		switch m := message.(type) {
-		case etf.Tuple:
-			switch mtag := m[0].(type) {
-			case etf.Atom:
-				gs.lock.Lock()
-				switch mtag {
-				case etf.Atom("$gen_call"):
-
-					go func() {
-						fromTuple := m[1].(etf.Tuple)
-						code, reply, state1 := pd.(GenServerInt).HandleCall(&fromTuple, &m[2], gs.state)
-
-						gs.state = state1
-						gs.lock.Unlock()
-						if code < 0 {
-							chstop <- code
-							return
-						}
-						if reply != nil && code == 1 {
-							pid := fromTuple[0].(etf.Pid)
-							ref := fromTuple[1]
-							rep := etf.Term(etf.Tuple{ref, *reply})
-							gs.Send(pid, &rep)
-						}
-					}()
-				case etf.Atom("$gen_cast"):
-					go func() {
-						code, state1 := pd.(GenServerInt).HandleCast(&m[1], gs.state)
-						gs.state = state1
-						gs.lock.Unlock()
-						if code < 0 {
-							chstop <- code
-							return
-						}
-					}()
-				default:
-					go func() {
-						code, state1 := pd.(GenServerInt).HandleInfo(&message, gs.state)
-						gs.state = state1
-						gs.lock.Unlock()
-						if code < 0 {
-							chstop <- code
-							return
-						}
-					}()
+		case reason := <-stopped:
+			exitReason = reason
+			return
+		case <-ctxDone:
+			lib.Log("[%#v]. Context is done. Stopping", gs.Self)
+			ctxDone = nil
+			gs.Stop(etf.Atom("shutdown"))
+			continue
+		case ex := <-pcs.exit:
+			gs.lock.Lock()
+			trapExit := gs.trapExit
+			gs.lock.Unlock()
+			if ex.kill {
+				lib.Log("[%#v]. Killed by %#v", gs.Self, ex.from)
+				close(killed)
+				exitReason = etf.Atom("killed")
+				return
+			}
+			if !trapExit {
+				if ex.reason == etf.Atom("normal") && ex.from != gs.Self {
+					continue
 				}
-			case etf.Ref:
-				lib.Log("got reply: %#v\n%#v", mtag, message)
-				gs.chreply <- &m
-			default:
-				lib.Log("mtag: %#v", mtag)
-				gs.lock.Lock()
-				go func() {
-					code, state1 := pd.(GenServerInt).HandleInfo(&message, gs.state)
-					gs.state = state1
-					gs.lock.Unlock()
-					if code < 0 {
-						chstop <- code
-						return
-					}
-				}()
+				// killed by exit signal. Terminate callback isn't called
+				// like it does Erlang for the processes not trapping exits
+				lib.Log("[%#v]. Killed with reason %#v", gs.Self, ex.reason)
+				close(killed)
+				exitReason = ex.reason
+				return
 			}
+			pcs.mailbox.push(ex.from, etf.Tuple{etf.Atom("EXIT"), ex.from, ex.reason})
+		}
+	}
+}
+
+// handleLoop handles messages from the mailbox one by one using callbacks
+// of behaviour implementation. It returns the exit reason via 'stopped' once
+// the process has been stopped and Terminate callback has been called
+func (gs *GenServer) handleLoop(pd Process, mb *mailbox, stopped chan etf.Term, killed chan bool) {
+	terminate := func(reason etf.Term) {
+		pd.(GenServerInt).Terminate(reason, gs.state)
+		select {
+		case stopped <- reason:
+		case <-killed:
+		}
+	}
+
+	for {
+		// stop request has priority over the messages in the mailbox
+		select {
+		case reason := <-gs.stop:
+			terminate(reason)
+			return
 		default:
-			lib.Log("m: %#v", m)
-			gs.lock.Lock()
-			go func() {
-				code, state1 := pd.(GenServerInt).HandleInfo(&message, gs.state)
-				gs.state = state1
-				gs.lock.Unlock()
-				if code < 0 {
-					chstop <- code
-					return
-				}
-			}()
+		}
+
+		select {
+		case reason := <-gs.stop:
+			terminate(reason)
+			return
+		case <-mb.ready:
+			m, ok := mb.pop()
+			if !ok {
+				continue
+			}
+			lib.Log("[%#v]. Message from %#v", gs.Self, m.from)
+			gs.handleMessage(pd, m.message)
+		case <-killed:
+			return
 		}
 	}
 }
 
+// handleMessage invokes callback for the given message
+func (gs *GenServer) handleMessage(pd Process, message etf.Term) {
+	var code int
+	defer gs.recoverCallback()
+
+	// malformed $gen_call and $gen_cast are handled by HandleInfo like any
+	// other message (as OTP does)
+	m, _ := message.(etf.Tuple)
+	switch {
+	case len(m) == 3 && m[0] == etf.Atom("$gen_call") && isCallFrom(m[1]):
+		var reply *etf.Term
+		fromTuple := m[1].(etf.Tuple)
+		code, reply, gs.state = pd.(GenServerInt).HandleCall(&fromTuple, &m[2], gs.state)
+		if code == 1 && reply != nil {
+			gs.Reply(fromTuple, *reply)
+		}
+	case len(m) == 2 && m[0] == etf.Atom("$gen_cast"):
+		code, gs.state = pd.(GenServerInt).HandleCast(&m[1], gs.state)
+	default:
+		lib.Log("[%#v]. Info: %#v", gs.Self, message)
+		code, gs.state = pd.(GenServerInt).HandleInfo(&message, gs.state)
+	}
+
+	if code < 0 {
+		gs.Stop(stopReason(code))
+	}
+}
+
+// isCallFrom checks whether the term is {Pid, Tag} of the $gen_call
+func isCallFrom(from etf.Term) bool {
+	t, ok := from.(etf.Tuple)
+	if !ok || len(t) != 2 {
+		return false
+	}
+	_, ok = t[0].(etf.Pid)
+	return ok
+}
+
 func (gs *GenServer) setNode(node *Node) {
 	gs.Node = node
 }
@@ -164,21 +233,14 @@ func (gs *GenServer) setPid(pid etf.Pid) {
 	gs.Self = pid
 }
 
+// Call makes synchronous request like gen_server:call does. Timeout (in
+// seconds) could be specified as an option. Default timeout is defined by
+// NodeOptions.CallTimeout (5 seconds)
 func (gs *GenServer) Call(to interface{}, message *etf.Term, options ...interface{}) (reply *etf.Term, err error) {
 	var (
-		option_timeout int = 5
+		option_timeout int = gs.Node.opts.CallTimeout
 	)
 
-	gs.chreply = make(chan *etf.Tuple)
-	defer close(gs.chreply)
-
-	ref := gs.Node.MakeRef()
-	from := etf.Tuple{gs.Self, ref}
-	msg := etf.Term(etf.Tuple{etf.Atom("$gen_call"), from, *message})
-	if err := gs.Node.Send(gs.Self, to, &msg); err != nil {
-		return nil, err
-	}
-
 	switch len(options) {
 	case 1:
 		switch options[0].(type) {
@@ -190,27 +252,140 @@ func (gs *GenServer) Call(to interface{}, message *etf.Term, options ...interfac
 
 	}
 
-	for {
-		select {
-		case m := <-gs.chreply:
-			retmsg := *m
-			ref1 := retmsg[0].(etf.Ref)
-			val := retmsg[1].(etf.Term)
-
-			//check by id
-			if ref.Id[0] == ref1.Id[0] && ref.Id[1] == ref1.Id[1] && ref.Id[2] == ref1.Id[2] {
-				reply = &val
-				goto out
-			}
-		case <-time.After(time.Second * time.Duration(option_timeout)):
-			err = errors.New("timeout")
-			goto out
+	ctx, cancel := context.WithTimeout(gs.Context(), time.Second*time.Duration(option_timeout))
+	defer cancel()
+	reply, err = gs.CallContext(ctx, to, message)
+	if err == context.DeadlineExceeded {
+		err = errors.New("timeout")
+	}
+	return
+}
+
+// CallContext makes synchronous request like Call does. The request (as well
+// as connection to the remote node) is aborted once the context is done.
+// The callee is monitored during the call, so the call fails immediately if
+// the callee doesn't exist or has died
+func (gs *GenServer) CallContext(ctx context.Context, to interface{}, message *etf.Term) (reply *etf.Term, err error) {
+	chreply := make(chan etf.Tuple, 1)
+	ref := gs.Node.MakeRef()
+	key := refKey(ref)
+	gs.lock.Lock()
+	if gs.calls == nil {
+		gs.calls = make(map[string]chan etf.Tuple)
+	}
+	gs.calls[key] = chreply
+	gs.lock.Unlock()
+	gs.Node.monitorRef(ctx, gs.Self, to, ref)
+
+	from := etf.Tuple{gs.Self, ref}
+	msg := etf.Term(etf.Tuple{etf.Atom("$gen_call"), from, *message})
+	if err := gs.Node.SendContext(ctx, gs.Self, to, &msg); err != nil {
+		gs.lock.Lock()
+		delete(gs.calls, key)
+		gs.lock.Unlock()
+		gs.cancelCall(ref)
+		return nil, err
+	}
+
+	select {
+	case m := <-chreply:
+		return gs.callResult(ref, m)
+	case <-ctx.Done():
+		gs.lock.Lock()
+		_, waiting := gs.calls[key]
+		delete(gs.calls, key)
+		gs.lock.Unlock()
+		if !waiting {
+			// the reply (or DOWN) has just arrived
+			return gs.callResult(ref, <-chreply)
 		}
+		gs.cancelCall(ref)
+		return nil, ctx.Err()
 	}
-out:
-	gs.chreply = nil
+}
 
-	return
+// routeCallReply passes the reply {Ref, Reply} or {'DOWN', Ref, ...} message
+// to the waiting Call. Returns false if there is no such call, so the message
+// goes to the mailbox (HandleInfo)
+func (gs *GenServer) routeCallReply(message etf.Term) bool {
+	m, ok := message.(etf.Tuple)
+	if !ok {
+		return false
+	}
+
+	var ref etf.Ref
+	isDown := false
+	switch {
+	case len(m) == 2:
+		if ref, ok = m[0].(etf.Ref); !ok {
+			return false
+		}
+	case len(m) == 5 && m[0] == etf.Atom("DOWN"):
+		if ref, ok = m[1].(etf.Ref); !ok {
+			return false
+		}
+		isDown = true
+	default:
+		return false
+	}
+
+	key := refKey(ref)
+	gs.lock.Lock()
+	chreply, waiting := gs.calls[key]
+	delete(gs.calls, key)
+	flush := isDown && gs.flushDown[key]
+	if isDown {
+		delete(gs.flushDown, key)
+	}
+	gs.lock.Unlock()
+
+	if waiting {
+		lib.Log("[%#v]. Got reply on the call: %#v", gs.Self, message)
+		chreply <- m
+		return true
+	}
+	if flush {
+		lib.Log("[%#v]. DOWN of the finished call is dropped: %#v", gs.Self, message)
+		return true
+	}
+	return false
+}
+
+// callResult handles the message routed to the Call
+func (gs *GenServer) callResult(ref etf.Ref, m etf.Tuple) (*etf.Term, error) {
+	if len(m) == 5 {
+		// {'DOWN', Ref, process, Pid, Reason}
+		if m[4] == etf.Atom("noproc") {
+			return nil, ErrNoProc
+		}
+		return nil, fmt.Errorf("DOWN: %#v", m[4])
+	}
+	gs.cancelCall(ref)
+	reply := m[1]
+	return &reply, nil
+}
+
+// cancelCall removes the monitor of the call. If the DOWN message has been
+// already sent it will be dropped
+func (gs *GenServer) cancelCall(ref etf.Ref) {
+	if gs.Node.Demonitor(ref) {
+		return
+	}
+	gs.lock.Lock()
+	if gs.flushDown == nil {
+		gs.flushDown = make(map[string]bool)
+	}
+	gs.flushDown[refKey(ref)] = true
+	gs.lock.Unlock()
+}
+
+// Context returns the context of the process. It's cancelled once the
+// process exits
+func (gs *GenServer) Context() context.Context {
+	if gs.context == nil {
+		return context.Background()
+	}
+	return gs.context
 }
 
 func (gs *GenServer) Cast(to interface{}, message *etf.Term) error {
@@ -226,10 +401,97 @@ func (gs *GenServer) Send(to etf.Pid, reply *etf.Term) {
 	gs.Node.Send(nil, to, reply)
 }
 
-func (gs *GenServer) Monitor(to etf.Pid) {
-	gs.Node.Monitor(gs.Self, to)
+// Monitor sets up monitor of the process specified by etf.Pid or
+// etf.Tuple{Name, Node}
+func (gs *GenServer) Monitor(to interface{}) etf.Ref {
+	return gs.Node.Monitor(gs.Self, to)
+}
+
+func (gs *GenServer) Demonitor(ref etf.Ref) bool {
+	return gs.Node.Demonitor(ref)
 }
 
 func (gs *GenServer) MonitorNode(to etf.Atom, flag bool) {
 	gs.Node.MonitorNode(gs.Self, to, flag)
 }
+
+func (gs *GenServer) Link(to etf.Pid) {
+	gs.Node.Link(gs.Self, to)
+}
+
+func (gs *GenServer) Unlink(to etf.Pid) {
+	gs.Node.Unlink(gs.Self, to)
+}
+
+// Stop makes the process exit with the given reason (normal, shutdown,
+// {shutdown, X} or any custom term) and calls Terminate callback.
+// It takes effect once the current callback returns
+func (gs *GenServer) Stop(reason etf.Term) {
+	select {
+	case gs.stop <- reason:
+	default:
+		// already stopping
+	}
+}
+
+// Exit sends an exit signal to the process 'to' like erlang:exit/2 does
+func (gs *GenServer) Exit(to etf.Pid, reason etf.Term) {
+	gs.Node.Exit(gs.Self, to, reason)
+}
+
+// SetTrapExit sets trap_exit flag of the process like
+// process_flag(trap_exit, Flag) does. Trapping process receives exit
+// signals as {'EXIT', From, Reason} messages via HandleInfo
+func (gs *GenServer) SetTrapExit(flag bool) {
+	gs.lock.Lock()
+	gs.trapExit = flag
+	gs.lock.Unlock()
+}
+
+// recoverCallback makes the process exit with reason {panic, Message}
+// if a callback has panicked
+func (gs *GenServer) recoverCallback() {
+	if r := recover(); r != nil {
+		log.Printf("GenServer %#v callback panic: %#v", gs.Self, r)
+		gs.Stop(etf.Tuple{etf.Atom("panic"), fmt.Sprint(r)})
+	}
+}
+
+// Reply sends the reply to the caller 'from' like gen_server:reply/2 does.
+// It allows HandleCall to return (0, nil, state) (noreply), keep the 'from'
+// tuple and answer the call later (from any goroutine)
+func (gs *GenServer) Reply(from etf.Tuple, reply etf.Term) {
+	if len(from) != 2 {
+		lib.Log("[%#v]. Wrong 'from' tuple of the call: %#v", gs.Self, from)
+		return
+	}
+	pid, ok := from[0].(etf.Pid)
+	if !ok {
+		lib.Log("[%#v]. Wrong 'from' tuple of the call: %#v", gs.Self, from)
+		return
+	}
+	rep := etf.Term(etf.Tuple{from[1], reply})
+	gs.Send(pid, &rep)
+}
+
+// ReplyAsync runs fn on a separate goroutine and replies to the caller 'from'
+// with its result. It allows HandleCall to return (0, nil, state) (noreply)
+// and keep handling other messages while the reply is being prepared
+func (gs *GenServer) ReplyAsync(from etf.Tuple, fn func() etf.Term) {
+	go func() {
+		gs.Reply(from, fn())
+	}()
+}
+
+// refKey makes the map key of the given reference
+func refKey(ref etf.Ref) string {
+	return fmt.Sprintf("%s.%d.%v", ref.Node, ref.Creation, ref.Id)
+}
+
+// stopReason converts callback stop code into the exit reason
+func stopReason(code int) etf.Term {
+	if code == -1 {
+		return etf.Atom("normal")
+	}
+	return code
+}
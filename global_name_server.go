@@ -1,17 +1,154 @@
 package ergonode
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
 	"github.com/halturin/ergonode/etf"
 	"github.com/halturin/ergonode/lib"
 )
 
+// globalVsn is the version of the protocol of OTP global module
+const globalVsn = 5
+
+// globalTransTimeout limits the attempts to lock the cluster on registering
+// or unregistering the name
+const globalTransTimeout = 30 * time.Second
+
+var (
+	// globalRID is the resource locked during the registration and the sync
+	// (?GLOBAL_RID of OTP global module)
+	globalRID = etf.Atom("global")
+	// globalMethod resolves the name conflicts like global:random_exit_name/3
+	globalMethod = etf.Export{Module: "global", Function: "random_exit_name", Arity: 3}
+)
+
+// globalName is the name registered in the cluster
+type globalName struct {
+	name   etf.Term
+	pid    etf.Pid
+	method etf.Term // resolves the conflicts (fun M:F/3)
+}
+
+// globalLock is the lock {ResourceId, LockRequesterId} set by the processes
+// 'pids'. The same lock could be set by several processes
+type globalLock struct {
+	resource  etf.Term
+	requester etf.Term
+	pids      []etf.Pid
+}
+
+// globalSync is the state of the synchronization with the node. It starts on
+// nodeup. Both nodes lock the cluster (using the same lock id), exchange the
+// names and resolve the conflicts. The lockers are the global name servers
+type globalSync struct {
+	tag        int // our tag of the sync session
+	hisTag     etf.Term
+	hisLocker  etf.Pid
+	connected  bool     // init_connect has been received
+	locking    bool     // lock attempt is in progress
+	waiting    bool     // lock is set by us. Waiting for the other locker
+	hisLockSet bool     // lock is set by the other locker
+	lockSet    bool     // lock is set by both lockers
+	lockID     etf.Term // {global, [Locker1, Locker2]}
+	locked     []etf.Atom
+	hisNames   etf.List
+	exchanged  bool // names of the node have been received
+	ops        etf.List
+	resolved   bool // names have been resolved by us
+	hisOps     etf.List
+	hisKnown   etf.List
+	hisDone    bool // names have been resolved by the node
+}
+
+// globalLocked is sent to the global name server once the lock attempt of
+// the sync is finished
+type globalLocked struct {
+	node   etf.Atom
+	tag    int
+	lockID etf.Term
+	nodes  []etf.Atom
+	ok     bool
+}
+
+// globalRetry restarts the lock attempt of the sync
+type globalRetry struct {
+	node etf.Atom
+	tag  int
+}
+
+// globalQueue runs the sends to the node one by one on its own goroutine. The
+// sends could connect to the node, so the slow (or unreachable) node doesn't
+// block the global name server and the rest of the nodes
+type globalQueue struct {
+	lock  sync.Mutex
+	queue []func()
+	ready chan struct{} // has a value while the queue isn't empty
+	done  chan struct{} // closed once the node is down
+}
+
+// globalNameServer is the cluster-wide name registry compatible with OTP
+// global module
 type globalNameServer struct {
 	GenServer
+
+	// stateLock guards names, locks, known and monitored. They are used by
+	// RegisterGlobal & co on the caller goroutine as well
+	stateLock sync.Mutex
+	names     map[string]globalName
+	locks     []*globalLock
+	known     []etf.Atom // nodes which are in sync with this one
+	monitored map[etf.Pid]bool
+
+	// transLock serializes the registrations of this node: they use the same
+	// lock id
+	transLock sync.Mutex
+
+	// queuesLock guards queues of the messages to the nodes
+	queuesLock sync.Mutex
+	queues     map[etf.Atom]*globalQueue
+
+	// used by the callbacks only
+	syncs      map[etf.Atom]*globalSync
+	preConnect map[etf.Atom]etf.Tuple // init_connect received before nodeup
+	tag        int
+}
+
+// RegisterGlobal registers the name in the cluster like
+// global:register_name/2 does. Name is any term (usually etf.Atom).
+// Returns ErrNameTaken if the name is registered already or ErrProcessNamed
+// if the process has another global name. Name is unregistered once the
+// process exits
+func (n *Node) RegisterGlobal(name etf.Term, pid etf.Pid) error {
+	return n.sysProcs.globalNameServer.register(name, pid)
+}
+
+// UnregisterGlobal removes the name from the cluster like
+// global:unregister_name/1 does
+func (n *Node) UnregisterGlobal(name etf.Term) error {
+	return n.sysProcs.globalNameServer.unregister(name)
+}
+
+// WhereisGlobal returns the pid registered with the name in the cluster
+// like global:whereis_name/1 does
+func (n *Node) WhereisGlobal(name etf.Term) (etf.Pid, bool) {
+	return n.sysProcs.globalNameServer.whereis(name)
 }
 
 func (gns *globalNameServer) Init(args ...interface{}) (state interface{}) {
 	lib.Log("GLOBAL_NAME_SERVER: Init: %#v", args)
 	gns.Node.Register(etf.Atom("global_name_server"), gns.Self)
+	gns.names = make(map[string]globalName)
+	gns.monitored = make(map[etf.Pid]bool)
+	gns.syncs = make(map[etf.Atom]*globalSync)
+	gns.preConnect = make(map[etf.Atom]etf.Tuple)
+	gns.queues = make(map[etf.Atom]*globalQueue)
+	gns.Node.monitorNodes(gns.Self, true)
 	return nil
 }
 
@@ -19,6 +156,51 @@ func (gns *globalNameServer) HandleCast(message *etf.Term, state interface{}) (c
 	lib.Log("GLOBAL_NAME_SERVER: HandleCast: %#v", *message)
 	stateout = state
 	code = 0
+	m, ok := (*message).(etf.Tuple)
+	if !ok || len(m) == 0 {
+		return
+	}
+	switch m[0] {
+	case etf.Atom("init_connect"):
+		// {init_connect, {Vsn, HisTag}, Node, {locker, _, HisKnown, HisTheLocker}}
+		if len(m) != 4 {
+			break
+		}
+		if node, ok := m[2].(etf.Atom); ok {
+			gns.initConnect(node, m)
+		}
+	case etf.Atom("exchange"):
+		// {exchange, Node, NameList, NameExtList, MyTag}
+		if len(m) != 5 {
+			break
+		}
+		if node, ok := m[1].(etf.Atom); ok {
+			gns.exchange(node, globalList(m[2]), m[4])
+		}
+	case etf.Atom("resolved"):
+		// {resolved, Node, HisResolved, HisKnown, HisKnown_v2, Names_ext, MyTag}
+		if len(m) != 7 {
+			break
+		}
+		if node, ok := m[1].(etf.Atom); ok {
+			gns.resolvedBy(node, globalList(m[2]), globalList(m[3]), m[6])
+		}
+	case etf.Atom("new_nodes"):
+		// {new_nodes, Node, Ops, Names_ext, Nodes, ExtraInfo}
+		if len(m) == 6 {
+			gns.newNodes(globalList(m[2]), globalList(m[4]))
+		}
+	case etf.Atom("in_sync"):
+		// {in_sync, Node, IsKnown}
+		if len(m) < 2 {
+			break
+		}
+		if node, ok := m[1].(etf.Atom); ok {
+			gns.inSync(node)
+		}
+	default:
+		lib.Log("GLOBAL_NAME_SERVER: unexpected cast %#v", m)
+	}
 	return
 }
 
@@ -26,7 +208,39 @@ func (gns *globalNameServer) HandleCall(from *etf.Tuple, message *etf.Term, stat
 	lib.Log("GLOBAL_NAME_SERVER: HandleCall: %#v, From: %#v", *message, *from)
 	stateout = state
 	code = 1
-	replyTerm := etf.Term(etf.Atom("reply"))
+	var replyTerm etf.Term
+	m, _ := (*message).(etf.Tuple)
+	fromPid, _ := (*from)[0].(etf.Pid)
+	switch {
+	case len(m) == 2 && m[0] == etf.Atom("set_lock"):
+		// {set_lock, {ResourceId, LockRequesterId}}
+		lockID, ok := m[1].(etf.Tuple)
+		replyTerm = ok && len(lockID) == 2 && gns.setLock(lockID, fromPid)
+		if replyTerm == true {
+			gns.monitor(fromPid)
+		}
+	case len(m) == 2 && m[0] == etf.Atom("del_lock"):
+		if lockID, ok := m[1].(etf.Tuple); ok && len(lockID) == 2 {
+			gns.delLock(lockID, fromPid)
+		}
+		replyTerm = true
+	case len(m) == 4 && m[0] == etf.Atom("register"):
+		// {register, Name, Pid, Method}
+		pid, ok := m[2].(etf.Pid)
+		if !ok {
+			replyTerm = etf.Tuple{etf.Atom("error"), etf.Atom("badarg")}
+			break
+		}
+		gns.insertName(m[1], pid, m[3])
+		gns.monitor(pid)
+		replyTerm = etf.Atom("yes")
+	case len(m) == 2 && m[0] == etf.Atom("unregister"):
+		gns.deleteName(m[1])
+		replyTerm = etf.Atom("ok")
+	default:
+		lib.Log("GLOBAL_NAME_SERVER: unexpected call %#v", *message)
+		replyTerm = etf.Tuple{etf.Atom("error"), etf.Atom("badarg")}
+	}
 	reply = &replyTerm
 	return
 }
@@ -35,9 +249,843 @@ func (gns *globalNameServer) HandleInfo(message *etf.Term, state interface{}) (c
 	lib.Log("GLOBAL_NAME_SERVER: HandleInfo: %#v", *message)
 	stateout = state
 	code = 0
+	switch m := (*message).(type) {
+	case globalLocked:
+		gns.lockedBy(m)
+	case globalRetry:
+		if sync := gns.syncs[m.node]; sync != nil && sync.tag == m.tag {
+			gns.startLock(m.node, sync)
+		}
+	case etf.Tuple:
+		if len(m) == 0 {
+			return
+		}
+		switch m[0] {
+		case etf.Atom("nodeup"):
+			if len(m) != 2 {
+				break
+			}
+			if node, ok := m[1].(etf.Atom); ok {
+				gns.nodeup(node)
+			}
+		case etf.Atom("nodedown"):
+			if len(m) != 2 {
+				break
+			}
+			if node, ok := m[1].(etf.Atom); ok {
+				gns.nodedown(node)
+			}
+		case etf.Atom("lock_set"):
+			// {lock_set, HisTheLocker, IsLockSet, HisKnown}
+			if len(m) != 4 {
+				break
+			}
+			if pid, ok := m[1].(etf.Pid); ok {
+				gns.lockSetBy(pid, isTrue(m[2]))
+			}
+		case etf.Atom("DOWN"):
+			// the process holding the name or the lock is down
+			if len(m) != 5 {
+				break
+			}
+			if pid, ok := m[3].(etf.Pid); ok {
+				gns.down(pid)
+			}
+		}
+	}
 	return
 }
 
-func (gns *globalNameServer) Terminate(reason int, state interface{}) {
+func (gns *globalNameServer) Terminate(reason etf.Term, state interface{}) {
 	lib.Log("GLOBAL_NAME_SERVER: Terminate: %#v", reason)
 }
+
+// nodeup starts the sync with the node unless they are in sync already
+func (gns *globalNameServer) nodeup(node etf.Atom) {
+	if _, exists := gns.syncs[node]; exists || gns.isKnown(node) {
+		return
+	}
+	gns.tag++
+	sync := &globalSync{tag: gns.tag}
+	gns.syncs[node] = sync
+
+	locker := etf.Tuple{etf.Atom("locker"), etf.Atom("no_longer_a_pid"), gns.knownList(), gns.Self}
+	msg := etf.Term(etf.Tuple{
+		etf.Atom("init_connect"),
+		etf.Tuple{globalVsn, sync.tag},
+		etf.Atom(gns.Node.FullName),
+		locker,
+	})
+	gns.castTo(node, msg)
+
+	if m, exists := gns.preConnect[node]; exists {
+		delete(gns.preConnect, node)
+		gns.initConnect(node, m)
+	}
+}
+
+// nodedown cancels the sync with the node and removes its names and locks
+func (gns *globalNameServer) nodedown(node etf.Atom) {
+	gns.queuesLock.Lock()
+	if q, exists := gns.queues[node]; exists {
+		close(q.done)
+		delete(gns.queues, node)
+	}
+	gns.queuesLock.Unlock()
+	delete(gns.preConnect, node)
+	if sync, exists := gns.syncs[node]; exists {
+		gns.cancelSync(node, sync)
+	}
+
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	for i, n := range gns.known {
+		if n == node {
+			gns.known = append(gns.known[:i], gns.known[i+1:]...)
+			break
+		}
+	}
+	for pid := range gns.monitored {
+		if pid.Node == node {
+			gns.removePid(pid)
+		}
+	}
+}
+
+func (gns *globalNameServer) initConnect(node etf.Atom, m etf.Tuple) {
+	sync, exists := gns.syncs[node]
+	if !exists {
+		// nodeup hasn't been received yet
+		gns.preConnect[node] = m
+		return
+	}
+	vsn, ok1 := m[1].(etf.Tuple)
+	locker, ok2 := m[3].(etf.Tuple)
+	if !ok1 || !ok2 || len(vsn) < 2 || len(locker) != 4 {
+		lib.Log("GLOBAL_NAME_SERVER: malformed init_connect %#v", m)
+		return
+	}
+	hisLocker, ok := locker[3].(etf.Pid)
+	if !ok {
+		lib.Log("GLOBAL_NAME_SERVER: malformed init_connect %#v", m)
+		return
+	}
+	sync.hisTag = vsn[1]
+	sync.hisLocker = hisLocker
+	sync.connected = true
+	gns.startLock(node, sync)
+}
+
+// startLock tries to lock the cluster (the boss, both nodes and all the
+// known ones) on a separate goroutine. Result is sent back as globalLocked
+func (gns *globalNameServer) startLock(node etf.Atom, sync *globalSync) {
+	if !sync.connected || sync.locking || sync.waiting || sync.lockSet {
+		return
+	}
+	sync.locking = true
+	lockers := etf.List{gns.Self, sync.hisLocker}
+	if comparePids(sync.hisLocker, gns.Self) < 0 {
+		lockers = etf.List{sync.hisLocker, gns.Self}
+	}
+	lockID := etf.Tuple{globalRID, lockers}
+	nodes := gns.lockNodes(node)
+	tag := sync.tag
+	go func() {
+		msg := etf.Term(globalLocked{
+			node:   node,
+			tag:    tag,
+			lockID: lockID,
+			nodes:  nodes,
+			ok:     gns.setLockOn(nodes, lockID),
+		})
+		gns.Send(gns.Self, &msg)
+	}()
+}
+
+func (gns *globalNameServer) lockedBy(m globalLocked) {
+	sync, exists := gns.syncs[m.node]
+	if !exists || sync.tag != m.tag {
+		// sync has been cancelled
+		if m.ok {
+			go gns.delLockOn(m.nodes, m.lockID)
+		}
+		return
+	}
+	sync.locking = false
+	if !m.ok {
+		if sync.hisLockSet {
+			// the other locker is waiting for the answer
+			sync.hisLockSet = false
+			gns.sendLockSet(sync.hisLocker, false)
+		}
+		gns.retryLock(m.node, sync)
+		return
+	}
+
+	sync.lockID = m.lockID
+	sync.locked = m.nodes
+	gns.sendLockSet(sync.hisLocker, true)
+	if sync.hisLockSet {
+		gns.lockIsSet(m.node, sync)
+		return
+	}
+	sync.waiting = true
+}
+
+// lockSetBy handles {lock_set, Pid, IsLockSet, Known} of the other locker.
+// It's either the answer on our lock_set or its own attempt
+func (gns *globalNameServer) lockSetBy(pid etf.Pid, isSet bool) {
+	sync, exists := gns.syncs[pid.Node]
+	if !exists || !sync.connected {
+		if isSet {
+			gns.sendLockSet(pid, false)
+		}
+		return
+	}
+	if !isSet {
+		if sync.waiting {
+			sync.waiting = false
+			go gns.delLockOn(sync.locked, sync.lockID)
+			sync.locked = nil
+			gns.retryLock(pid.Node, sync)
+		}
+		return
+	}
+	if sync.waiting {
+		sync.waiting = false
+		gns.lockIsSet(pid.Node, sync)
+		return
+	}
+	if sync.lockSet {
+		return
+	}
+	sync.hisLockSet = true
+	gns.startLock(pid.Node, sync)
+}
+
+func (gns *globalNameServer) sendLockSet(to etf.Pid, isSet bool) {
+	gns.sendTo(to, etf.Tuple{etf.Atom("lock_set"), gns.Self, isSet, gns.knownList()})
+}
+
+func (gns *globalNameServer) retryLock(node etf.Atom, sync *globalSync) {
+	delay := 100*time.Millisecond + time.Duration(rand.Intn(900))*time.Millisecond
+	tag := sync.tag
+	time.AfterFunc(delay, func() {
+		msg := etf.Term(globalRetry{node: node, tag: tag})
+		gns.Send(gns.Self, &msg)
+	})
+}
+
+// lockIsSet sends our names to the node once the cluster is locked by both
+// lockers
+func (gns *globalNameServer) lockIsSet(node etf.Atom, sync *globalSync) {
+	sync.lockSet = true
+	msg := etf.Term(etf.Tuple{
+		etf.Atom("exchange"),
+		etf.Atom(gns.Node.FullName),
+		gns.namesList(),
+		etf.List{},
+		sync.hisTag,
+	})
+	gns.castTo(node, msg)
+	if sync.exchanged {
+		gns.resolve(node, sync)
+	}
+}
+
+func (gns *globalNameServer) exchange(node etf.Atom, names etf.List, tag etf.Term) {
+	sync, exists := gns.syncs[node]
+	if !exists || tag != sync.tag {
+		return
+	}
+	sync.hisNames = names
+	sync.exchanged = true
+	if sync.lockSet {
+		gns.resolve(node, sync)
+	}
+}
+
+// resolve finds out the names of the node to be inserted and resolves the
+// conflicts. Resolved ones are sent to the node
+func (gns *globalNameServer) resolve(node etf.Atom, sync *globalSync) {
+	var resolved etf.List
+	sync.ops, resolved = gns.exchangeNames(node, sync.hisNames)
+	sync.resolved = true
+	known := gns.knownList()
+	msg := etf.Term(etf.Tuple{
+		etf.Atom("resolved"),
+		etf.Atom(gns.Node.FullName),
+		resolved,
+		known,
+		known,
+		etf.List{},
+		sync.hisTag,
+	})
+	gns.castTo(node, msg)
+	if sync.hisDone {
+		gns.finishSync(node, sync)
+	}
+}
+
+func (gns *globalNameServer) resolvedBy(node etf.Atom, ops, known etf.List, tag etf.Term) {
+	sync, exists := gns.syncs[node]
+	if !exists || tag != sync.tag {
+		return
+	}
+	sync.hisOps = ops
+	sync.hisKnown = known
+	sync.hisDone = true
+	if sync.resolved {
+		gns.finishSync(node, sync)
+	}
+}
+
+// finishSync applies the resolved names, informs the known nodes about the
+// new ones and releases the lock
+func (gns *globalNameServer) finishSync(node etf.Atom, sync *globalSync) {
+	delete(gns.syncs, node)
+	ops := append(append(etf.List{}, sync.ops...), sync.hisOps...)
+	newNodes := append(etf.List{node}, sync.hisKnown...)
+	known := gns.knownList()
+	gns.syncOthers(sync.hisKnown)
+	gns.doOps(ops)
+
+	msg := etf.Term(etf.Tuple{
+		etf.Atom("new_nodes"),
+		etf.Atom(gns.Node.FullName),
+		ops,
+		etf.List{},
+		newNodes,
+		etf.List{},
+	})
+	gns.async(node, func() {
+		// new_nodes must be received before the lock is deleted. The queue
+		// of the node keeps it after our resolved as well
+		for _, k := range known {
+			gns.Cast(etf.Tuple{etf.Atom("global_name_server"), k}, &msg)
+		}
+		gns.delLockOn(sync.locked, sync.lockID)
+	})
+	gns.addKnown(newNodes)
+}
+
+func (gns *globalNameServer) newNodes(ops, nodes etf.List) {
+	var added etf.List
+	for _, n := range nodes {
+		if node, ok := n.(etf.Atom); ok && !gns.isKnown(node) {
+			added = append(added, node)
+		}
+	}
+	gns.syncOthers(added)
+	gns.doOps(ops)
+	gns.addKnown(added)
+}
+
+// inSync is received from the node which is in sync with us by means of
+// another one
+func (gns *globalNameServer) inSync(node etf.Atom) {
+	if sync, exists := gns.syncs[node]; exists {
+		gns.cancelSync(node, sync)
+	}
+	gns.addKnown(etf.List{node})
+}
+
+// syncOthers tells the nodes (connecting to them) that they are in sync
+// with this one
+func (gns *globalNameServer) syncOthers(nodes etf.List) {
+	msg := etf.Term(etf.Tuple{etf.Atom("in_sync"), etf.Atom(gns.Node.FullName), true})
+	for _, n := range nodes {
+		node, ok := n.(etf.Atom)
+		if !ok || string(node) == gns.Node.FullName {
+			continue
+		}
+		gns.castTo(node, msg)
+	}
+}
+
+func (gns *globalNameServer) cancelSync(node etf.Atom, sync *globalSync) {
+	delete(gns.syncs, node)
+	if sync.hisLockSet && sync.locking {
+		gns.sendLockSet(sync.hisLocker, false)
+	}
+	if len(sync.locked) > 0 {
+		go gns.delLockOn(sync.locked, sync.lockID)
+	}
+}
+
+// exchangeNames returns the operations on our names {insert, {Name, Pid,
+// Method}} | {delete, Name} and the resolved conflicts to be sent to the
+// node. Conflicts are resolved by the node with the lesser name
+func (gns *globalNameServer) exchangeNames(node etf.Atom, names etf.List) (ops, resolved etf.List) {
+	for _, n := range names {
+		t, ok := n.(etf.Tuple)
+		if !ok || len(t) != 3 {
+			continue
+		}
+		pid, ok := t[1].(etf.Pid)
+		if !ok {
+			continue
+		}
+		gns.stateLock.Lock()
+		our, exists := gns.names[termKey(t[0])]
+		gns.stateLock.Unlock()
+		switch {
+		case !exists:
+			ops = append(ops, etf.Tuple{etf.Atom("insert"), t})
+		case our.pid == pid || gns.Node.FullName > string(node):
+			// the same one or the node resolves the conflict
+		default:
+			switch gns.resolveConflict(our.method, t[0], pid, our.pid) {
+			case pid:
+				ops = append(ops, etf.Tuple{etf.Atom("insert"), t})
+			case our.pid:
+				op := etf.Tuple{etf.Atom("insert"), etf.Tuple{our.name, our.pid, our.method}}
+				resolved = append(resolved, op)
+			default:
+				op := etf.Tuple{etf.Atom("delete"), t[0]}
+				ops = append(ops, op)
+				resolved = append(resolved, op)
+			}
+		}
+	}
+	return
+}
+
+// resolveConflict applies the method of global module to the pids
+// registered with the same name. Returns the pid keeping the name (or the
+// atom 'none'). Unknown methods are handled like random_exit_name
+func (gns *globalNameServer) resolveConflict(method, name etf.Term, pid1, pid2 etf.Pid) etf.Term {
+	min, max := pid1, pid2
+	if comparePids(pid2, pid1) < 0 {
+		min, max = pid2, pid1
+	}
+	function := etf.Atom("random_exit_name")
+	if export, ok := method.(etf.Export); ok && export.Module == etf.Atom("global") {
+		function = export.Function
+	}
+	switch function {
+	case etf.Atom("random_notify_name"):
+		gns.sendTo(max, etf.Tuple{etf.Atom("global_name_conflict"), name})
+		return min
+	case etf.Atom("notify_all_names"):
+		gns.sendTo(pid1, etf.Tuple{etf.Atom("global_name_conflict"), name, pid2})
+		gns.sendTo(pid2, etf.Tuple{etf.Atom("global_name_conflict"), name, pid1})
+		return etf.Atom("none")
+	default:
+		lib.Log("GLOBAL_NAME_SERVER: Name conflict terminating %#v", etf.Tuple{name, max})
+		gns.async(max.Node, func() {
+			gns.Node.Exit(gns.Self, max, etf.Atom("kill"))
+		})
+		return min
+	}
+}
+
+func (gns *globalNameServer) doOps(ops etf.List) {
+	for _, o := range ops {
+		op, ok := o.(etf.Tuple)
+		if !ok || len(op) != 2 {
+			continue
+		}
+		switch op[0] {
+		case etf.Atom("insert"):
+			t, ok := op[1].(etf.Tuple)
+			if !ok || len(t) != 3 {
+				continue
+			}
+			if pid, ok := t[1].(etf.Pid); ok {
+				gns.insertName(t[0], pid, t[2])
+				gns.monitor(pid)
+			}
+		case etf.Atom("delete"):
+			gns.deleteName(op[1])
+		}
+	}
+}
+
+func (gns *globalNameServer) register(name etf.Term, pid etf.Pid) error {
+	var err error
+	terr := gns.trans(func(nodes []etf.Atom) {
+		gns.stateLock.Lock()
+		if _, exists := gns.names[termKey(name)]; exists {
+			err = ErrNameTaken
+		} else {
+			for _, n := range gns.names {
+				if n.pid == pid {
+					err = ErrProcessNamed
+					break
+				}
+			}
+		}
+		if err == nil {
+			gns.names[termKey(name)] = globalName{name: name, pid: pid, method: globalMethod}
+		}
+		gns.stateLock.Unlock()
+		if err != nil {
+			return
+		}
+		gns.monitor(pid)
+		gns.multiCall(nodes, etf.Tuple{etf.Atom("register"), name, pid, globalMethod})
+	})
+	if terr != nil {
+		return terr
+	}
+	return err
+}
+
+func (gns *globalNameServer) unregister(name etf.Term) error {
+	if _, exists := gns.whereis(name); !exists {
+		return nil
+	}
+	return gns.trans(func(nodes []etf.Atom) {
+		gns.deleteName(name)
+		gns.multiCall(nodes, etf.Tuple{etf.Atom("unregister"), name})
+	})
+}
+
+func (gns *globalNameServer) whereis(name etf.Term) (etf.Pid, bool) {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	n, exists := gns.names[termKey(name)]
+	return n.pid, exists
+}
+
+// trans runs fn while the cluster is locked by this node like
+// global:trans/2 does
+func (gns *globalNameServer) trans(fn func(nodes []etf.Atom)) error {
+	gns.transLock.Lock()
+	defer gns.transLock.Unlock()
+
+	lockID := etf.Tuple{globalRID, gns.Self}
+	deadline := time.Now().Add(globalTransTimeout)
+	for {
+		nodes := gns.lockNodes("")
+		if gns.setLockOn(nodes, lockID) {
+			fn(nodes)
+			gns.delLockOn(nodes, lockID)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("can't lock the global name registry")
+		}
+		delay := 100*time.Millisecond + time.Duration(rand.Intn(900))*time.Millisecond
+		select {
+		case <-time.After(delay):
+		case <-gns.Context().Done():
+			return gns.Context().Err()
+		}
+	}
+}
+
+// multiCall makes the call to the global name servers of the nodes (except
+// this one)
+func (gns *globalNameServer) multiCall(nodes []etf.Atom, message etf.Term) {
+	for _, node := range nodes {
+		if string(node) == gns.Node.FullName {
+			continue
+		}
+		if _, err := gns.Call(etf.Tuple{etf.Atom("global_name_server"), node}, &message); err != nil {
+			lib.Log("GLOBAL_NAME_SERVER: call to %s has failed: %s", node, err)
+		}
+	}
+}
+
+// lockNodes returns the nodes to be locked: the boss (the greatest one)
+// first, then this node, the given one and the known ones
+func (gns *globalNameServer) lockNodes(extra etf.Atom) []etf.Atom {
+	self := etf.Atom(gns.Node.FullName)
+	gns.stateLock.Lock()
+	known := append([]etf.Atom{}, gns.known...)
+	gns.stateLock.Unlock()
+
+	boss := self
+	for _, node := range known {
+		if node > boss {
+			boss = node
+		}
+	}
+	nodes := []etf.Atom{boss}
+	for _, node := range append([]etf.Atom{self, extra}, known...) {
+		exists := node == ""
+		for _, n := range nodes {
+			exists = exists || n == node
+		}
+		if !exists {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// setLockOn sets the lock on the nodes one by one. Lock is deleted from all
+// of them if any has refused it
+func (gns *globalNameServer) setLockOn(nodes []etf.Atom, lockID etf.Tuple) bool {
+	for i, node := range nodes {
+		isSet := false
+		if string(node) == gns.Node.FullName {
+			isSet = gns.setLock(lockID, gns.Self)
+		} else {
+			msg := etf.Term(etf.Tuple{etf.Atom("set_lock"), lockID})
+			reply, err := gns.Call(etf.Tuple{etf.Atom("global_name_server"), node}, &msg)
+			isSet = err == nil && isTrue(*reply)
+		}
+		if !isSet {
+			gns.delLockOn(nodes[:i], lockID)
+			return false
+		}
+	}
+	return true
+}
+
+func (gns *globalNameServer) delLockOn(nodes []etf.Atom, lockID etf.Term) {
+	id, ok := lockID.(etf.Tuple)
+	if !ok {
+		return
+	}
+	for _, node := range nodes {
+		if string(node) == gns.Node.FullName {
+			gns.delLock(id, gns.Self)
+			continue
+		}
+		msg := etf.Term(etf.Tuple{etf.Atom("del_lock"), id})
+		gns.Call(etf.Tuple{etf.Atom("global_name_server"), node}, &msg)
+	}
+}
+
+// setLock sets the lock {ResourceId, LockRequesterId} by the process. Lock
+// of the resource could be shared by the processes with the same requester
+// id only
+func (gns *globalNameServer) setLock(lockID etf.Tuple, pid etf.Pid) bool {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	for _, l := range gns.locks {
+		if !reflect.DeepEqual(l.resource, lockID[0]) {
+			continue
+		}
+		if !reflect.DeepEqual(l.requester, lockID[1]) {
+			return false
+		}
+		for _, p := range l.pids {
+			if p == pid {
+				return true
+			}
+		}
+		l.pids = append(l.pids, pid)
+		return true
+	}
+	gns.locks = append(gns.locks, &globalLock{resource: lockID[0], requester: lockID[1], pids: []etf.Pid{pid}})
+	return true
+}
+
+func (gns *globalNameServer) delLock(lockID etf.Tuple, pid etf.Pid) {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	for i, l := range gns.locks {
+		if !reflect.DeepEqual(l.resource, lockID[0]) || !reflect.DeepEqual(l.requester, lockID[1]) {
+			continue
+		}
+		if l.pids = removePid(l.pids, pid); len(l.pids) == 0 {
+			gns.locks = append(gns.locks[:i], gns.locks[i+1:]...)
+		}
+		return
+	}
+}
+
+// monitor sets the monitor of the process holding the name or the lock
+func (gns *globalNameServer) monitor(pid etf.Pid) {
+	if pid == gns.Self {
+		return
+	}
+	gns.stateLock.Lock()
+	monitored := gns.monitored[pid]
+	gns.monitored[pid] = true
+	gns.stateLock.Unlock()
+	if !monitored {
+		gns.async(pid.Node, func() {
+			gns.Monitor(pid)
+		})
+	}
+}
+
+func (gns *globalNameServer) down(pid etf.Pid) {
+	gns.stateLock.Lock()
+	gns.removePid(pid)
+	gns.stateLock.Unlock()
+}
+
+// removePid removes the names and the locks of the process. Must be called
+// with stateLock held
+func (gns *globalNameServer) removePid(pid etf.Pid) {
+	delete(gns.monitored, pid)
+	for key, n := range gns.names {
+		if n.pid == pid {
+			delete(gns.names, key)
+		}
+	}
+	locks := gns.locks[:0]
+	for _, l := range gns.locks {
+		if l.pids = removePid(l.pids, pid); len(l.pids) > 0 {
+			locks = append(locks, l)
+		}
+	}
+	gns.locks = locks
+}
+
+func (gns *globalNameServer) insertName(name etf.Term, pid etf.Pid, method etf.Term) {
+	gns.stateLock.Lock()
+	gns.names[termKey(name)] = globalName{name: name, pid: pid, method: method}
+	gns.stateLock.Unlock()
+}
+
+func (gns *globalNameServer) deleteName(name etf.Term) {
+	gns.stateLock.Lock()
+	delete(gns.names, termKey(name))
+	gns.stateLock.Unlock()
+}
+
+// namesList returns the names as [{Name, Pid, Method}]
+func (gns *globalNameServer) namesList() etf.List {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	names := etf.List{}
+	for _, n := range gns.names {
+		names = append(names, etf.Tuple{n.name, n.pid, n.method})
+	}
+	return names
+}
+
+func (gns *globalNameServer) knownList() etf.List {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	known := etf.List{}
+	for _, node := range gns.known {
+		known = append(known, node)
+	}
+	return known
+}
+
+func (gns *globalNameServer) isKnown(node etf.Atom) bool {
+	gns.stateLock.Lock()
+	defer gns.stateLock.Unlock()
+	for _, n := range gns.known {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (gns *globalNameServer) addKnown(nodes etf.List) {
+	for _, n := range nodes {
+		node, ok := n.(etf.Atom)
+		if !ok || string(node) == gns.Node.FullName || gns.isKnown(node) {
+			continue
+		}
+		gns.stateLock.Lock()
+		gns.known = append(gns.known, node)
+		gns.stateLock.Unlock()
+	}
+}
+
+// castTo casts the message to the global name server of the node
+func (gns *globalNameServer) castTo(node etf.Atom, message etf.Term) {
+	gns.async(node, func() {
+		gns.Cast(etf.Tuple{etf.Atom("global_name_server"), node}, &message)
+	})
+}
+
+// sendTo sends the message to the process. Message to the remote one is
+// sent asynchronously
+func (gns *globalNameServer) sendTo(to etf.Pid, message etf.Term) {
+	if string(to.Node) == gns.Node.FullName {
+		gns.Send(to, &message)
+		return
+	}
+	gns.async(to.Node, func() {
+		gns.Send(to, &message)
+	})
+}
+
+// async runs fn on the goroutine of the node queue (fn is called right away
+// for this node). Functions of the same node are called in order
+func (gns *globalNameServer) async(node etf.Atom, fn func()) {
+	if string(node) == gns.Node.FullName {
+		fn()
+		return
+	}
+	gns.queuesLock.Lock()
+	q, exists := gns.queues[node]
+	if !exists {
+		q = &globalQueue{ready: make(chan struct{}, 1), done: make(chan struct{})}
+		gns.queues[node] = q
+		go gns.runQueue(q)
+	}
+	gns.queuesLock.Unlock()
+
+	q.lock.Lock()
+	q.queue = append(q.queue, fn)
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (gns *globalNameServer) runQueue(q *globalQueue) {
+	for {
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		case <-gns.Context().Done():
+			return
+		}
+		q.lock.Lock()
+		queue := q.queue
+		q.queue = nil
+		q.lock.Unlock()
+		for _, fn := range queue {
+			fn()
+		}
+	}
+}
+
+// termKey makes the map key of the term
+func termKey(t etf.Term) string {
+	var b bytes.Buffer
+	if err := new(etf.Context).Write(&b, t); err != nil {
+		return fmt.Sprintf("%#v", t)
+	}
+	return b.String()
+}
+
+// comparePids compares pids like Erlang does: by node, then by number (Id),
+// then by serial
+func comparePids(a, b etf.Pid) int {
+	switch {
+	case a.Node != b.Node:
+		if a.Node < b.Node {
+			return -1
+		}
+		return 1
+	case a.Id != b.Id:
+		if a.Id < b.Id {
+			return -1
+		}
+		return 1
+	case a.Serial != b.Serial:
+		if a.Serial < b.Serial {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func globalList(t etf.Term) etf.List {
+	l, _ := t.(etf.List)
+	return l
+}
+
+func isTrue(t etf.Term) bool {
+	return t == true || t == etf.Atom("true")
+}
@@ -0,0 +1,337 @@
+package ergonode
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// waitGlobal waits for the name to be registered with the pid on the node
+// (empty pid waits for the name to be unregistered)
+func waitGlobal(t *testing.T, node *Node, name etf.Term, pid etf.Pid) {
+	for i := 0; i < 300; i++ {
+		p, exists := node.WhereisGlobal(name)
+		if p == pid && exists == (pid != etf.Pid{}) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p, _ := node.WhereisGlobal(name)
+	t.Fatalf("%s: expected %v registered as %v, got %v", node.FullName, pid, name, p)
+}
+
+func TestGlobalRegister(t *testing.T) {
+	nodes := newPipeNodes(t, 3, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2, node3 := nodes[0], nodes[1], nodes[2]
+
+	gs1 := new(testEchoServer)
+	pid1 := node1.Spawn(gs1)
+	if err := node1.RegisterGlobal(etf.Atom("gs1"), pid1); err != nil {
+		t.Fatal(err)
+	}
+
+	// names are exchanged on connect
+	if err := connect(context.Background(), node2, etf.Atom(node1.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node2, etf.Atom("gs1"), pid1)
+
+	// registration is propagated to the known nodes
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+	if err := node2.RegisterGlobal(etf.Tuple{etf.Atom("gs"), 2}, pid2); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node1, etf.Tuple{etf.Atom("gs"), 2}, pid2)
+
+	if err := node2.RegisterGlobal(etf.Atom("gs1"), pid2); err != ErrNameTaken {
+		t.Fatalf("expected %v, got %v", ErrNameTaken, err)
+	}
+	if err := node1.RegisterGlobal(etf.Atom("gs2"), pid2); err != ErrProcessNamed {
+		t.Fatalf("expected %v, got %v", ErrProcessNamed, err)
+	}
+
+	// node3 gets in sync with node1 by means of node2
+	if err := connect(context.Background(), node3, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node3, etf.Atom("gs1"), pid1)
+	waitGlobal(t, node3, etf.Tuple{etf.Atom("gs"), 2}, pid2)
+
+	// {global, Name} is the target of the calls
+	gs3 := new(testEchoServer)
+	node3.Spawn(gs3)
+	message := etf.Term(etf.Atom("hello"))
+	reply, err := gs3.Call(etf.Tuple{etf.Atom("global"), etf.Atom("gs1")}, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reply != message {
+		t.Fatalf("expected %#v, got %#v", message, *reply)
+	}
+	if _, err := gs3.Call(etf.Tuple{etf.Atom("global"), etf.Atom("unknown")}, &message); err == nil {
+		t.Fatal("call to the unknown global name has succeeded")
+	}
+	err = node3.Send(gs3.Self, etf.Tuple{etf.Atom("global"), etf.Atom("unknown")}, &message)
+	if err != ErrNoProc {
+		t.Fatalf("expected %v, got %v", ErrNoProc, err)
+	}
+
+	if err := node3.UnregisterGlobal(etf.Atom("gs1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		waitGlobal(t, node, etf.Atom("gs1"), etf.Pid{})
+	}
+
+	// name of the exited process is removed
+	node2.Exit(pid2, pid2, etf.Atom("kill"))
+	for _, node := range nodes {
+		waitGlobal(t, node, etf.Tuple{etf.Atom("gs"), 2}, etf.Pid{})
+	}
+}
+
+func TestGlobalConflict(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	pid1 := node1.Spawn(new(testEchoServer))
+	pid2 := node2.Spawn(new(testEchoServer))
+	if err := node1.RegisterGlobal(etf.Atom("gs"), pid1); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.RegisterGlobal(etf.Atom("gs"), pid2); err != nil {
+		t.Fatal(err)
+	}
+
+	// random_exit_name keeps the lesser pid and kills the other one
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node1, etf.Atom("gs"), pid1)
+	waitGlobal(t, node2, etf.Atom("gs"), pid1)
+	for i := 0; ; i++ {
+		if _, exists := node2.getProcess(pid2); !exists {
+			break
+		}
+		if i == 100 {
+			t.Fatal("process of the conflicting name is still alive")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, exists := node1.getProcess(pid1); !exists {
+		t.Fatal("process keeping the name has exited")
+	}
+}
+
+func TestGlobalNodedown(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	pid2 := node2.Spawn(new(testEchoServer))
+	if err := node2.RegisterGlobal(etf.Atom("gs"), pid2); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node1, etf.Atom("gs"), pid2)
+
+	// names of the disconnected node are removed, and the nodes get in sync
+	// again on reconnect
+	disconnect(node1, node2)
+	waitGlobal(t, node1, etf.Atom("gs"), etf.Pid{})
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitGlobal(t, node1, etf.Atom("gs"), pid2)
+}
+
+func TestComparePids(t *testing.T) {
+	pid := etf.Pid{Node: etf.Atom("b@localhost"), Id: 10, Serial: 1}
+	for _, c := range []struct {
+		pid    etf.Pid
+		expect int
+	}{
+		{etf.Pid{Node: etf.Atom("b@localhost"), Id: 10, Serial: 1}, 0},
+		{etf.Pid{Node: etf.Atom("a@localhost"), Id: 20, Serial: 2}, -1},
+		{etf.Pid{Node: etf.Atom("c@localhost"), Id: 1, Serial: 0}, 1},
+		// number is compared before serial
+		{etf.Pid{Node: etf.Atom("b@localhost"), Id: 9, Serial: 2}, -1},
+		{etf.Pid{Node: etf.Atom("b@localhost"), Id: 11, Serial: 0}, 1},
+		{etf.Pid{Node: etf.Atom("b@localhost"), Id: 10, Serial: 0}, -1},
+		{etf.Pid{Node: etf.Atom("b@localhost"), Id: 10, Serial: 2}, 1},
+	} {
+		if result := comparePids(c.pid, pid); result != c.expect {
+			t.Fatalf("comparing %v with %v: expected %d, got %d", c.pid, pid, c.expect, result)
+		}
+	}
+}
+
+// testGlobalPeer pretends to be the global name server of OTP node. Its
+// casts and calls are passed to the info channel as {'$gen_cast', Message}
+// and {'$gen_call', Message}. Every call is replied with true
+type testGlobalPeer struct {
+	testInfoServer
+}
+
+func (gs *testGlobalPeer) Init(args ...interface{}) (state interface{}) {
+	gs.Node.Register(etf.Atom("global_name_server"), gs.Self)
+	return nil
+}
+
+func (gs *testGlobalPeer) HandleCast(message *etf.Term, state interface{}) (int, interface{}) {
+	gs.info <- etf.Tuple{etf.Atom("$gen_cast"), *message}
+	return 0, state
+}
+
+func (gs *testGlobalPeer) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (int, *etf.Term, interface{}) {
+	gs.info <- etf.Tuple{etf.Atom("$gen_call"), *message}
+	reply := etf.Term(true)
+	return 1, &reply, state
+}
+
+// TestGlobalProtocol checks the messages of the sync against the ones of
+// OTP global module (vsn 5)
+func TestGlobalProtocol(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+	name1, name2 := etf.Atom(node1.FullName), etf.Atom(node2.FullName)
+
+	// replace the global name server of node2 with the fake one
+	gns2 := node2.sysProcs.globalNameServer.Self
+	node2.Exit(gns2, gns2, etf.Atom("kill"))
+	for i := 0; ; i++ {
+		if _, exists := node2.Whereis(etf.Atom("global_name_server")); !exists {
+			break
+		}
+		if i == 300 {
+			t.Fatal("global name server of node2 is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	peer := &testGlobalPeer{testInfoServer: *newTestInfoServer(false)}
+	node2.Spawn(peer)
+	if pid, _ := node2.Whereis(etf.Atom("global_name_server")); pid != peer.Self {
+		t.Fatalf("expected %v registered, got %v", peer.Self, pid)
+	}
+
+	gns1 := node1.sysProcs.globalNameServer.Self
+	pid1 := node1.Spawn(new(testEchoServer))
+	if err := node1.RegisterGlobal(etf.Atom("go_name"), pid1); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(context.Background(), node1, name2); err != nil {
+		t.Fatal(err)
+	}
+	cast := func(message etf.Term) {
+		peer.Cast(etf.Tuple{etf.Atom("global_name_server"), name1}, &message)
+	}
+	expect := func(expected etf.Term) {
+		if message := peer.waitInfo(t); !reflect.DeepEqual(message, expected) {
+			t.Fatalf("expected %#v, got %#v", expected, message)
+		}
+	}
+
+	// {init_connect, {Vsn, Tag}, Node, {locker, no_longer_a_pid, Known, TheLocker}}
+	m, _ := peer.waitInfo(t).(etf.Tuple)
+	if len(m) != 2 || m[0] != etf.Atom("$gen_cast") {
+		t.Fatalf("expected init_connect cast, got %#v", m)
+	}
+	initConnect, _ := m[1].(etf.Tuple)
+	vsn, _ := initConnect.Element(2).(etf.Tuple)
+	if len(initConnect) != 4 || len(vsn) != 2 {
+		t.Fatalf("malformed init_connect %#v", initConnect)
+	}
+	tag := vsn[1]
+	expected := etf.Tuple{
+		etf.Atom("init_connect"),
+		etf.Tuple{5, tag},
+		name1,
+		etf.Tuple{etf.Atom("locker"), etf.Atom("no_longer_a_pid"), etf.List{}, gns1},
+	}
+	if !reflect.DeepEqual(initConnect, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, initConnect)
+	}
+	cast(etf.Tuple{
+		etf.Atom("init_connect"),
+		etf.Tuple{5, 77},
+		name2,
+		etf.Tuple{etf.Atom("locker"), etf.Atom("no_longer_a_pid"), etf.List{}, peer.Self},
+	})
+
+	// lock {global, [Locker1, Locker2]} is set on both nodes, then the
+	// lockers tell each other {lock_set, Locker, true, Known}
+	lockers := etf.List{gns1, peer.Self}
+	if comparePids(peer.Self, gns1) < 0 {
+		lockers = etf.List{peer.Self, gns1}
+	}
+	lockID := etf.Tuple{etf.Atom("global"), lockers}
+	expect(etf.Tuple{etf.Atom("$gen_call"), etf.Tuple{etf.Atom("set_lock"), lockID}})
+	expect(etf.Tuple{etf.Atom("lock_set"), gns1, etf.Atom("true"), etf.List{}})
+	lockSet := etf.Term(etf.Tuple{etf.Atom("lock_set"), peer.Self, true, etf.List{}})
+	peer.Send(gns1, &lockSet)
+
+	// {exchange, Node, NameList, NameExtList, HisTag}
+	method := etf.Export{Module: "global", Function: "random_exit_name", Arity: 3}
+	expect(etf.Tuple{etf.Atom("$gen_cast"), etf.Tuple{
+		etf.Atom("exchange"),
+		name1,
+		etf.List{etf.Tuple{etf.Atom("go_name"), pid1, method}},
+		etf.List{},
+		77,
+	}})
+	cast(etf.Tuple{
+		etf.Atom("exchange"),
+		name2,
+		etf.List{etf.Tuple{etf.Atom("erl_name"), peer.Self, method}},
+		etf.List{},
+		tag,
+	})
+
+	// {resolved, Node, HisResolved, HisKnown, HisKnown_v2, Names_ext, HisTag}
+	expect(etf.Tuple{etf.Atom("$gen_cast"), etf.Tuple{
+		etf.Atom("resolved"),
+		name1,
+		etf.List{},
+		etf.List{},
+		etf.List{},
+		etf.List{},
+		77,
+	}})
+	cast(etf.Tuple{
+		etf.Atom("resolved"),
+		name2,
+		etf.List{},
+		etf.List{},
+		etf.List{},
+		etf.List{},
+		tag,
+	})
+
+	// the lock is released once the names are applied
+	expect(etf.Tuple{etf.Atom("$gen_call"), etf.Tuple{etf.Atom("del_lock"), lockID}})
+	waitGlobal(t, node1, etf.Atom("erl_name"), peer.Self)
+
+	// malformed requests are replied with {error, badarg}
+	badarg := etf.Tuple{etf.Atom("error"), etf.Atom("badarg")}
+	for _, request := range []etf.Term{
+		etf.Tuple{etf.Atom("register"), etf.Atom("name"), etf.Atom("not_a_pid"), method},
+		etf.Tuple{etf.Atom("unknown_request")},
+	} {
+		reply, err := peer.Call(etf.Tuple{etf.Atom("global_name_server"), name1}, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*reply, badarg) {
+			t.Fatalf("%#v: expected %#v, got %#v", request, badarg, *reply)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package ergonode
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/dist"
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestSimultaneousConnect(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+	name1, name2 := etf.Atom(node1.FullName), etf.Atom(node2.FullName)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	wg.Add(4)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = connect(context.Background(), node1, name2)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = connect(context.Background(), node2, name1)
+		}(i + 2)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("connect %d has failed: %s", i, err)
+		}
+	}
+
+	if nodes := node1.Nodes(); len(nodes) != 1 || nodes[0] != name2 {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+	if nodes := node2.Nodes(); len(nodes) != 1 || nodes[0] != name1 {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+	message := etf.Term(etf.Atom("hello"))
+	if _, err := gs1.Call(pid2, &message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeNotAllowed(t *testing.T) {
+	opts := NodeOptions{Transport: NewPipeTransport()}
+	node1 := newPipeNode(t, "allowed1@localhost", "cookie", opts)
+	defer node1.Stop(context.Background())
+
+	// mandatory EXTENDED_REFERENCES flag is missing
+	opts.DistFlags = dist.DefaultFlags &^ uint64(dist.EXTENDED_REFERENCES)
+	node2 := newPipeNode(t, "allowed2@localhost", "cookie", opts)
+	defer node2.Stop(context.Background())
+
+	if err := connect(context.Background(), node2, "allowed1@localhost"); err != dist.ErrStatusNotAllowed {
+		t.Fatalf("expected %q, got %v", dist.ErrStatusNotAllowed, err)
+	}
+	if nodes := node1.Nodes(); len(nodes) != 0 {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+}
+
+func TestNodeCookies(t *testing.T) {
+	opts := NodeOptions{Transport: NewPipeTransport()}
+	gateway := newPipeNode(t, "gateway@localhost", "cookie1", opts)
+	node1 := newPipeNode(t, "cluster1@localhost", "cookie1", opts)
+	node2 := newPipeNode(t, "cluster2@localhost", "cookie2", opts)
+	node3 := newPipeNode(t, "cluster3@localhost", "cookie3", opts)
+	defer stopNodes([]*Node{gateway, node1, node2, node3})
+
+	if err := connect(context.Background(), gateway, "cluster2@localhost"); err == nil {
+		t.Fatal("connection with wrong cookie has been made")
+	}
+
+	gateway.SetCookie("cluster2@localhost", "cookie2")
+	if cookie := gateway.GetCookie("cluster2@localhost"); cookie != "cookie2" {
+		t.Fatalf("expected cookie2, got %s", cookie)
+	}
+	if err := connect(context.Background(), gateway, "cluster1@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(context.Background(), gateway, "cluster2@localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	// incoming connection uses the cookie of the remote node as well
+	gateway.SetCookie("cluster3@localhost", "cookie3")
+	if err := connect(context.Background(), node3, "gateway@localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	// default cookie is changed by setting the cookie of the node itself
+	gateway.SetCookie("gateway@localhost", "cookie4")
+	if cookie := gateway.GetCookie("cluster1@localhost"); cookie != "cookie4" {
+		t.Fatalf("expected cookie4, got %s", cookie)
+	}
+	// accepting node registers the connection once it has sent the ack
+	for i := 0; len(gateway.Nodes()) != 3; i++ {
+		if i == 100 {
+			t.Fatalf("wrong list of the connected nodes %v", gateway.Nodes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectAbandoned(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+	name2 := etf.Atom(node2.FullName)
+
+	// the caller gives up, but the attempt isn't aborted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := connect(ctx, node1, name2); err != nil && err != context.Canceled {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if nodes := node1.Nodes(); len(nodes) == 1 && nodes[0] == name2 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("connection has been aborted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSilentIncomingConnection(t *testing.T) {
+	opts := NodeOptions{Transport: NewPipeTransport()}
+	nodes := newPipeNodes(t, 2, opts)
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	// the peer connects and says nothing
+	silent, err := opts.Transport.Dial(context.Background(), "silent", node2.FullName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// empty handshake message closes the connection
+	empty, err := opts.Transport.Dial(context.Background(), "empty", node2.FullName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if _, err := empty.Write([]byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	empty.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := empty.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is still open")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatal("connection hasn't been closed")
+	}
+
+	// neither of them blocks the other incoming connections
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := connect(ctx, node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package ergonode
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// testEchoServer replies on the calls with the request
+type testEchoServer struct {
+	GenServer
+}
+
+func (gs *testEchoServer) Init(args ...interface{}) (state interface{}) {
+	return nil
+}
+
+func (gs *testEchoServer) HandleCast(message *etf.Term, state interface{}) (int, interface{}) {
+	return 0, state
+}
+
+func (gs *testEchoServer) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (int, *etf.Term, interface{}) {
+	return 1, message, state
+}
+
+func (gs *testEchoServer) HandleInfo(message *etf.Term, state interface{}) (int, interface{}) {
+	return 0, state
+}
+
+func (gs *testEchoServer) Terminate(reason etf.Term, state interface{}) {
+}
+
+// testInfoServer forwards the messages handled by HandleInfo to 'info'
+type testInfoServer struct {
+	testEchoServer
+	trapExit bool
+	info     chan etf.Term
+}
+
+func newTestInfoServer(trapExit bool) *testInfoServer {
+	return &testInfoServer{
+		trapExit: trapExit,
+		info:     make(chan etf.Term, 100),
+	}
+}
+
+func (gs *testInfoServer) Options() map[string]interface{} {
+	options := gs.GenServer.Options()
+	options["trap-exit"] = gs.trapExit
+	return options
+}
+
+func (gs *testInfoServer) HandleInfo(message *etf.Term, state interface{}) (int, interface{}) {
+	gs.info <- *message
+	return 0, state
+}
+
+// waitInfo returns the next message handled by HandleInfo
+func (gs *testInfoServer) waitInfo(t *testing.T) etf.Term {
+	select {
+	case message := <-gs.info:
+		return message
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message has been received")
+	}
+	return nil
+}
+
+// newPipeNode creates the node using the pipe transport of opts (new one if
+// it isn't set). There is no EPMD: pipe transport doesn't use it
+func newPipeNode(t *testing.T, name, cookie string, opts NodeOptions) *Node {
+	if opts.Transport == nil {
+		opts.Transport = NewPipeTransport()
+	}
+	opts.EPMDPort = 1
+	opts.DisableEPMDServer = true
+	node, err := Create(name, cookie, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// newPipeNodes creates n nodes (node1@localhost...) sharing the same pipe
+// transport. Use stopNodes to stop them
+func newPipeNodes(t *testing.T, n int, opts NodeOptions) []*Node {
+	if opts.Transport == nil {
+		opts.Transport = NewPipeTransport()
+	}
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		nodes[i] = newPipeNode(t, fmt.Sprintf("node%d@localhost", i+1), "cookie", opts)
+	}
+	return nodes
+}
+
+// disconnect closes the connection between the nodes (processes keep
+// running unlike on stopping the node)
+func disconnect(node1, node2 *Node) {
+	node1.lock.Lock()
+	conn, exists := node1.connections[etf.Atom(node2.FullName)]
+	node1.lock.Unlock()
+	if exists {
+		conn.conn.Close()
+	}
+}
+
+func stopNodes(nodes []*Node) {
+	for _, node := range nodes {
+		node.Stop(context.Background())
+	}
+}
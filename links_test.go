@@ -0,0 +1,65 @@
+package ergonode
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// linkRemote links gs to the process pid of the other node. Link is set up
+// once the call made after it has been handled: messages over the
+// connection are ordered
+func linkRemote(t *testing.T, gs *testInfoServer, pid etf.Pid) {
+	gs.Link(pid)
+	message := etf.Term(etf.Atom("ping"))
+	if _, err := gs.Call(pid, &message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkExitPropagation(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	// trapping process receives the exit reason of the linked one
+	gs1 := newTestInfoServer(true)
+	node1.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+	linkRemote(t, gs1, pid2)
+	gs2.Stop(etf.Atom("custom"))
+	exit := etf.Tuple{etf.Atom("EXIT"), pid2, etf.Atom("custom")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, exit) {
+		t.Fatalf("expected %#v, got %#v", exit, message)
+	}
+
+	// not trapping one exits with the same reason
+	gs3 := newTestInfoServer(false)
+	pid3 := node1.Spawn(gs3)
+	gs4 := new(testEchoServer)
+	pid4 := node2.Spawn(gs4)
+	linkRemote(t, gs3, pid4)
+	gs4.Stop(etf.Atom("custom"))
+	for i := 0; ; i++ {
+		if _, exists := node1.getProcess(pid3); !exists {
+			break
+		}
+		if i == 100 {
+			t.Fatal("linked process is still alive")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// links to the disconnected node are broken with reason noconnection
+	gs5 := new(testEchoServer)
+	pid5 := node2.Spawn(gs5)
+	linkRemote(t, gs1, pid5)
+	disconnect(node1, node2)
+	exit = etf.Tuple{etf.Atom("EXIT"), pid5, etf.Atom("noconnection")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, exit) {
+		t.Fatalf("expected %#v, got %#v", exit, message)
+	}
+}
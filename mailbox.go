@@ -0,0 +1,156 @@
+package ergonode
+
+import (
+	"sync"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// MailboxPolicy defines what happens once the bounded mailbox is full
+type MailboxPolicy int
+
+const (
+	// MailboxDropNewest drops the incoming message
+	MailboxDropNewest MailboxPolicy = iota
+	// MailboxDropOldest drops the oldest message of the mailbox to make room
+	// for the incoming one
+	MailboxDropOldest
+	// MailboxKill kills the process (with reason 'killed') like the
+	// max_heap_size process flag does in Erlang
+	MailboxKill
+)
+
+// MailboxInfo describes the state of the process mailbox (like
+// erlang:process_info(Pid, message_queue_len))
+type MailboxInfo struct {
+	Len           int    // number of the messages in the mailbox
+	HighWatermark int    // max number of the messages the mailbox has held
+	Dropped       uint64 // number of the messages dropped due to the overflow
+}
+
+// mailboxMessage is the message with the sender (nil if unknown)
+type mailboxMessage struct {
+	from    etf.Term
+	message etf.Term
+}
+
+// mailbox is the queue of the incoming messages of the process. Sending to
+// the mailbox never blocks, so the slow process can't stall the sender (e.g.
+// the reader of the connection). Mailbox is unbounded if size is zero.
+// Otherwise the policy is applied once it's full
+type mailbox struct {
+	lock   sync.Mutex
+	queue  []mailboxMessage
+	size   int
+	policy MailboxPolicy
+	// ready has a value while the mailbox isn't empty
+	ready chan struct{}
+	// filter intercepts the messages before queueing (e.g. replies on
+	// the calls). Message is dropped if filter returns true
+	filter   func(message etf.Term) bool
+	overflow func() // invoked once the mailbox with MailboxKill policy is full
+
+	highWatermark int
+	dropped       uint64
+	killed        bool
+}
+
+func newMailbox(size int, policy MailboxPolicy, overflow func()) *mailbox {
+	if size < 0 {
+		size = 0
+	}
+	return &mailbox{
+		size:     size,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		overflow: overflow,
+	}
+}
+
+// setFilter sets the function intercepting the incoming messages
+func (mb *mailbox) setFilter(filter func(message etf.Term) bool) {
+	mb.lock.Lock()
+	mb.filter = filter
+	mb.lock.Unlock()
+}
+
+// push puts the message into the mailbox. Never blocks
+func (mb *mailbox) push(from, message etf.Term) {
+	mb.lock.Lock()
+	filter := mb.filter
+	mb.lock.Unlock()
+	if filter != nil && filter(message) {
+		return
+	}
+
+	mb.lock.Lock()
+	if mb.killed {
+		mb.lock.Unlock()
+		return
+	}
+	if mb.size > 0 && len(mb.queue) >= mb.size {
+		mb.dropped++
+		switch mb.policy {
+		case MailboxDropOldest:
+			mb.queue[0] = mailboxMessage{}
+			mb.queue = mb.queue[1:]
+		case MailboxKill:
+			mb.killed = true
+			mb.queue = nil
+			mb.lock.Unlock()
+			if mb.overflow != nil {
+				mb.overflow()
+			}
+			return
+		default:
+			mb.lock.Unlock()
+			return
+		}
+	}
+	mb.queue = append(mb.queue, mailboxMessage{from: from, message: message})
+	if len(mb.queue) > mb.highWatermark {
+		mb.highWatermark = len(mb.queue)
+	}
+	mb.lock.Unlock()
+
+	select {
+	case mb.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the oldest message from the mailbox. Returns false if the
+// mailbox is empty. Should be called once a value has been received from
+// the 'ready' channel
+func (mb *mailbox) pop() (m mailboxMessage, ok bool) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if len(mb.queue) == 0 {
+		return
+	}
+	m = mb.queue[0]
+	mb.queue[0] = mailboxMessage{}
+	mb.queue = mb.queue[1:]
+	if len(mb.queue) == 0 {
+		// release the underlying array
+		mb.queue = nil
+		return m, true
+	}
+	select {
+	case mb.ready <- struct{}{}:
+	default:
+	}
+	return m, true
+}
+
+func (mb *mailbox) info() MailboxInfo {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	return MailboxInfo{
+		Len:           len(mb.queue),
+		HighWatermark: mb.highWatermark,
+		Dropped:       mb.dropped,
+	}
+}
@@ -0,0 +1,209 @@
+package ergonode
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// testBlockedServer doesn't handle messages until 'release' is closed
+type testBlockedServer struct {
+	GenServer
+	size    int
+	policy  MailboxPolicy
+	release chan struct{}
+	handled chan etf.Term
+}
+
+func (gs *testBlockedServer) Options() map[string]interface{} {
+	options := gs.GenServer.Options()
+	options["mailbox-size"] = gs.size
+	options["mailbox-policy"] = gs.policy
+	return options
+}
+
+func (gs *testBlockedServer) Init(args ...interface{}) (state interface{}) {
+	return nil
+}
+
+func (gs *testBlockedServer) HandleCast(message *etf.Term, state interface{}) (int, interface{}) {
+	return 0, state
+}
+
+func (gs *testBlockedServer) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (int, *etf.Term, interface{}) {
+	return 1, message, state
+}
+
+func (gs *testBlockedServer) HandleInfo(message *etf.Term, state interface{}) (int, interface{}) {
+	<-gs.release
+	gs.handled <- *message
+	return 0, state
+}
+
+func (gs *testBlockedServer) Terminate(reason etf.Term, state interface{}) {
+}
+
+func TestMailboxPolicies(t *testing.T) {
+	node := newPipeNode(t, "mailbox@localhost", "cookie", NodeOptions{})
+	defer node.Stop(context.Background())
+
+	cases := []struct {
+		policy MailboxPolicy
+		next   etf.Term // message handled after the first one
+	}{
+		{MailboxDropNewest, 1},
+		{MailboxDropOldest, 91},
+	}
+	for _, c := range cases {
+		gs := &testBlockedServer{
+			size:    10,
+			policy:  c.policy,
+			release: make(chan struct{}),
+			handled: make(chan etf.Term, 100),
+		}
+		pid := node.Spawn(gs)
+		message := etf.Term(0)
+		node.Send(nil, pid, &message)
+		// wait for the handler to take the first message
+		for i := 0; ; i++ {
+			if info, _ := node.MailboxInfo(pid); info.Len == 0 {
+				break
+			}
+			if i == 100 {
+				t.Fatal("message hasn't been handled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 1; i <= 100; i++ {
+			message := etf.Term(i)
+			node.Send(nil, pid, &message)
+		}
+		info, err := node.MailboxInfo(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Len != 10 || info.HighWatermark != 10 || info.Dropped != 90 {
+			t.Fatalf("policy %d: wrong mailbox info %+v", c.policy, info)
+		}
+		close(gs.release)
+		if first := <-gs.handled; first != 0 {
+			t.Fatalf("policy %d: expected 0, got %v", c.policy, first)
+		}
+		if second := <-gs.handled; second != c.next {
+			t.Fatalf("policy %d: expected %d, got %v", c.policy, c.next, second)
+		}
+	}
+
+	gs := &testBlockedServer{
+		size:    10,
+		policy:  MailboxKill,
+		release: make(chan struct{}),
+		handled: make(chan etf.Term, 100),
+	}
+	pid := node.Spawn(gs)
+	defer close(gs.release)
+	for i := 0; i < 100; i++ {
+		message := etf.Term(i)
+		node.Send(nil, pid, &message)
+	}
+	for i := 0; ; i++ {
+		if _, err := node.MailboxInfo(pid); err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("process hasn't been killed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMailboxDoesNotBlockConnection(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	// unbounded mailbox of the blocked process
+	blocked := &testBlockedServer{
+		release: make(chan struct{}),
+		handled: make(chan etf.Term, 1000),
+	}
+	blockedPid := node2.Spawn(blocked)
+	defer close(blocked.release)
+	echoPid := node2.Spawn(new(testEchoServer))
+
+	gs := new(testEchoServer)
+	node1.Spawn(gs)
+	for i := 0; i < 1000; i++ {
+		message := etf.Term(i)
+		if err := node1.Send(nil, blockedPid, &message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other processes of the node are still reachable
+	message := etf.Term(etf.Atom("hello"))
+	if _, err := gs.Call(echoPid, &message); err != nil {
+		t.Fatal(err)
+	}
+	info, err := node2.MailboxInfo(blockedPid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Len < 999 || info.Dropped != 0 {
+		t.Fatalf("wrong mailbox info %+v", info)
+	}
+}
+
+// testSlowInit doesn't return from Init until 'release' is closed
+type testSlowInit struct {
+	testEchoServer
+	started chan etf.Pid
+	release chan struct{}
+}
+
+func (gs *testSlowInit) Init(args ...interface{}) (state interface{}) {
+	gs.started <- gs.Self
+	<-gs.release
+	return nil
+}
+
+func TestExitSignalsDoNotBlock(t *testing.T) {
+	node := newPipeNode(t, "mailbox@localhost", "cookie", NodeOptions{})
+	defer node.Stop(context.Background())
+
+	gs := &testSlowInit{
+		started: make(chan etf.Pid),
+		release: make(chan struct{}),
+	}
+	go node.Spawn(gs)
+	pid := <-gs.started
+
+	// nobody takes the exit signals while the process is in Init
+	from := etf.Pid{Node: etf.Atom(node.FullName), Id: 12345}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < exitChanSize*2; i++ {
+			node.exitSignal(from, pid, etf.Atom("normal"), false)
+		}
+		node.exitSignal(from, pid, etf.Atom("kill"), false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sending of the exit signals is blocked")
+	}
+
+	close(gs.release)
+	for i := 0; ; i++ {
+		if _, exists := node.getProcess(pid); !exists {
+			break
+		}
+		if i == 100 {
+			t.Fatal("process hasn't been killed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package ergonode
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestMakeRefUnique(t *testing.T) {
+	node := newPipeNode(t, "ref@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+
+	refs := make(map[string]bool)
+	for i := 0; i < 100000; i++ {
+		key := refKey(node.MakeRef())
+		if refs[key] {
+			t.Fatalf("duplicate reference %s", key)
+		}
+		refs[key] = true
+	}
+}
+
+func TestMonitorNode(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs := newTestInfoServer(false)
+	node1.Spawn(gs)
+
+	// unreachable node is reported as down immediately
+	gs.MonitorNode("unknown@localhost", true)
+	nodedown := etf.Tuple{etf.Atom("nodedown"), etf.Atom("unknown@localhost")}
+	if message := gs.waitInfo(t); !reflect.DeepEqual(message, nodedown) {
+		t.Fatalf("expected %#v, got %#v", nodedown, message)
+	}
+
+	// every monitor fires once
+	gs.MonitorNode(etf.Atom(node2.FullName), true)
+	gs.MonitorNode(etf.Atom(node2.FullName), true)
+	node2.Stop(context.Background())
+	nodedown = etf.Tuple{etf.Atom("nodedown"), etf.Atom(node2.FullName)}
+	for i := 0; i < 2; i++ {
+		if message := gs.waitInfo(t); !reflect.DeepEqual(message, nodedown) {
+			t.Fatalf("expected %#v, got %#v", nodedown, message)
+		}
+	}
+	node1.lock.Lock()
+	monitors := len(node1.monitors)
+	node1.lock.Unlock()
+	if monitors != 0 {
+		t.Fatalf("monitors of the node haven't been removed")
+	}
+}
+
+func TestMonitorDown(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := newTestInfoServer(false)
+	node1.Spawn(gs1)
+
+	// remote process exits
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+	ref := gs1.Monitor(pid2)
+	message := etf.Term(etf.Atom("ping"))
+	if _, err := gs1.Call(pid2, &message); err != nil {
+		t.Fatal(err)
+	}
+	gs2.Stop(etf.Atom("custom"))
+	down := etf.Tuple{etf.Atom("DOWN"), ref, etf.Atom("process"), pid2, etf.Atom("custom")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, down) {
+		t.Fatalf("expected %#v, got %#v", down, message)
+	}
+
+	// monitored process doesn't exist
+	ref = gs1.Monitor(pid2)
+	down = etf.Tuple{etf.Atom("DOWN"), ref, etf.Atom("process"), pid2, etf.Atom("noproc")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, down) {
+		t.Fatalf("expected %#v, got %#v", down, message)
+	}
+
+	// connection is closed
+	gs3 := new(testEchoServer)
+	pid3 := node2.Spawn(gs3)
+	ref = gs1.Monitor(pid3)
+	if _, err := gs1.Call(pid3, &message); err != nil {
+		t.Fatal(err)
+	}
+	disconnect(node1, node2)
+	down = etf.Tuple{etf.Atom("DOWN"), ref, etf.Atom("process"), pid3, etf.Atom("noconnection")}
+	if message := gs1.waitInfo(t); !reflect.DeepEqual(message, down) {
+		t.Fatalf("expected %#v, got %#v", down, message)
+	}
+}
@@ -19,4 +19,6 @@ const (
 	MONITOR_EXIT   = 21
 	SEND_SENDER    = 22
 	SEND_SENDER_TT = 23
+	UNLINK_ID      = 35
+	UNLINK_ID_ACK  = 36
 )
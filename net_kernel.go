@@ -49,6 +49,6 @@ func (nk *netKernel) HandleInfo(message *etf.Term, state interface{}) (code int,
 	return
 }
 
-func (nk *netKernel) Terminate(reason int, state interface{}) {
+func (nk *netKernel) Terminate(reason etf.Term, state interface{}) {
 	lib.Log("NET_KERNEL: Terminate: %#v", reason)
 }
@@ -0,0 +1,410 @@
+package ergonode
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/halturin/ergonode/etf"
+	"github.com/halturin/ergonode/lib"
+)
+
+// pgGroup is the group of the processes. The process could join the group
+// several times, so pids could be repeated
+type pgGroup struct {
+	group etf.Term
+	pids  []etf.Pid
+}
+
+// pgPeer is the scope of the connected node
+type pgPeer struct {
+	ref    etf.Ref // monitor of the peer
+	groups map[string]*pgGroup
+}
+
+// pgScope is the default scope 'pg' of the process groups compatible with OTP
+// pg module. The scopes of the connected nodes (peers) discover each other
+// and exchange the members of the groups
+type pgScope struct {
+	GenServer
+
+	// outbox queues the messages to the peers as {Peer, Message}. They are
+	// queued with stateLock held to keep their order consistent with the
+	// state, and sent by the separate goroutine, so the slow peer blocks
+	// neither the scope nor the callers of Join and Leave
+	outbox *outbox
+
+	// stateLock guards all the fields below
+	stateLock sync.Mutex
+	local     map[string]*pgGroup // groups of the local processes
+	remote    map[etf.Pid]*pgPeer // groups of the peers
+	monitored map[etf.Pid]bool    // local processes joined any group
+}
+
+// Join joins the local process to the group like pg:join/2 does. The
+// process could join the same group several times. It leaves all the groups
+// once it exits
+func (n *Node) Join(group etf.Term, pid etf.Pid) error {
+	return n.sysProcs.pg.join(group, pid)
+}
+
+// Leave removes the process from the group like pg:leave/2 does. Returns
+// ErrNotJoined if the process isn't the member of the group
+func (n *Node) Leave(group etf.Term, pid etf.Pid) error {
+	return n.sysProcs.pg.leave(group, pid)
+}
+
+// GetMembers returns the processes of the group across the cluster like
+// pg:get_members/1 does
+func (n *Node) GetMembers(group etf.Term) []etf.Pid {
+	return n.sysProcs.pg.members(group, true)
+}
+
+// GetLocalMembers returns the local processes of the group like
+// pg:get_local_members/1 does
+func (n *Node) GetLocalMembers(group etf.Term) []etf.Pid {
+	return n.sysProcs.pg.members(group, false)
+}
+
+func (pg *pgScope) Init(args ...interface{}) (state interface{}) {
+	lib.Log("PG: Init: %#v", args)
+	pg.Node.Register(etf.Atom("pg"), pg.Self)
+	pg.local = make(map[string]*pgGroup)
+	pg.remote = make(map[etf.Pid]*pgPeer)
+	pg.monitored = make(map[etf.Pid]bool)
+	pg.outbox = newOutbox()
+	go pg.sender()
+	pg.Node.monitorNodes(pg.Self, true)
+	for _, node := range pg.Node.Nodes() {
+		pg.discover(node)
+	}
+	return nil
+}
+
+func (pg *pgScope) HandleCast(message *etf.Term, state interface{}) (code int, stateout interface{}) {
+	lib.Log("PG: HandleCast: %#v", *message)
+	return 0, state
+}
+
+func (pg *pgScope) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (code int, reply *etf.Term, stateout interface{}) {
+	lib.Log("PG: HandleCall: %#v, From: %#v", *message, *from)
+	return 0, nil, state
+}
+
+func (pg *pgScope) HandleInfo(message *etf.Term, state interface{}) (code int, stateout interface{}) {
+	lib.Log("PG: HandleInfo: %#v", *message)
+	stateout = state
+	code = 0
+	m, ok := (*message).(etf.Tuple)
+	if !ok || len(m) < 2 {
+		return
+	}
+	switch m[0] {
+	case etf.Atom("discover"):
+		// {discover, Peer} or {discover, Peer, ProtocolVersion}
+		if peer, ok := m[1].(etf.Pid); ok {
+			pg.discovered(peer)
+		}
+	case etf.Atom("join"):
+		// {join, Peer, Group, PidOrPids}
+		if len(m) != 4 {
+			break
+		}
+		if peer, ok := m[1].(etf.Pid); ok {
+			pg.joined(peer, m[2], pgPids(m[3]))
+		}
+	case etf.Atom("leave"):
+		// {leave, Peer, PidOrPids, Groups}
+		if len(m) != 4 {
+			break
+		}
+		if peer, ok := m[1].(etf.Pid); ok {
+			pg.left(peer, pgPids(m[2]), globalList(m[3]))
+		}
+	case etf.Atom("sync"):
+		// {sync, Peer, [{Group, Pids}]}
+		if len(m) != 3 {
+			break
+		}
+		if peer, ok := m[1].(etf.Pid); ok {
+			pg.synced(peer, globalList(m[2]))
+		}
+	case etf.Atom("nodeup"):
+		if node, ok := m[1].(etf.Atom); ok {
+			pg.discover(node)
+		}
+	case etf.Atom("nodedown"):
+		if node, ok := m[1].(etf.Atom); ok {
+			pg.nodedown(node)
+		}
+	case etf.Atom("DOWN"):
+		// {'DOWN', Ref, process, Pid, Reason}
+		if len(m) != 5 {
+			break
+		}
+		ref, ok1 := m[1].(etf.Ref)
+		pid, ok2 := m[3].(etf.Pid)
+		if ok1 && ok2 {
+			pg.down(ref, pid)
+		}
+	}
+	return
+}
+
+func (pg *pgScope) Terminate(reason etf.Term, state interface{}) {
+	lib.Log("PG: Terminate: %#v", reason)
+}
+
+// discover sends {discover, Self} to the scope of the node
+func (pg *pgScope) discover(node etf.Atom) {
+	msg := etf.Term(etf.Tuple{etf.Atom("discover"), pg.Self})
+	pg.Node.Send(pg.Self, etf.Tuple{etf.Atom("pg"), node}, &msg)
+}
+
+// discovered replies with the local groups to the peer. The peer is
+// monitored and discovered in return unless it's known already
+func (pg *pgScope) discovered(peer etf.Pid) {
+	pg.stateLock.Lock()
+	pg.send(peer, etf.Tuple{etf.Atom("sync"), pg.Self, pg.localGroups()})
+	p, exists := pg.remote[peer]
+	if !exists {
+		p = &pgPeer{groups: make(map[string]*pgGroup)}
+		pg.remote[peer] = p
+		pg.send(peer, etf.Tuple{etf.Atom("discover"), pg.Self})
+	}
+	pg.stateLock.Unlock()
+	if !exists {
+		pg.monitorPeer(peer, p)
+	}
+}
+
+func (pg *pgScope) joined(peer etf.Pid, group etf.Term, pids []etf.Pid) {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	p, exists := pg.remote[peer]
+	if !exists {
+		// not discovered yet. Its sync will have the group
+		return
+	}
+	groups := p.groups
+	key := termKey(group)
+	if _, exists := groups[key]; !exists {
+		groups[key] = &pgGroup{group: group}
+	}
+	groups[key].pids = append(groups[key].pids, pids...)
+}
+
+func (pg *pgScope) left(peer etf.Pid, pids []etf.Pid, groups etf.List) {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	p, exists := pg.remote[peer]
+	if !exists {
+		return
+	}
+	peerGroups := p.groups
+	for _, group := range groups {
+		key := termKey(group)
+		g, exists := peerGroups[key]
+		if !exists {
+			continue
+		}
+		for _, pid := range pids {
+			g.pids = removePid(g.pids, pid)
+		}
+		if len(g.pids) == 0 {
+			delete(peerGroups, key)
+		}
+	}
+}
+
+// synced replaces the groups of the peer
+func (pg *pgScope) synced(peer etf.Pid, groups etf.List) {
+	pg.stateLock.Lock()
+	p, exists := pg.remote[peer]
+	if !exists {
+		p = &pgPeer{}
+		pg.remote[peer] = p
+	}
+	peerGroups := make(map[string]*pgGroup)
+	for _, g := range groups {
+		t, ok := g.(etf.Tuple)
+		if !ok || len(t) != 2 {
+			continue
+		}
+		if pids := pgPids(t[1]); len(pids) > 0 {
+			peerGroups[termKey(t[0])] = &pgGroup{group: t[0], pids: pids}
+		}
+	}
+	p.groups = peerGroups
+	pg.stateLock.Unlock()
+	if !exists {
+		pg.monitorPeer(peer, p)
+	}
+}
+
+func (pg *pgScope) nodedown(node etf.Atom) {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	for peer := range pg.remote {
+		if peer.Node == node {
+			delete(pg.remote, peer)
+		}
+	}
+}
+
+// down removes the exited local process from its groups (or the groups of
+// the peer if it's down)
+func (pg *pgScope) down(ref etf.Ref, pid etf.Pid) {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	if p, exists := pg.remote[pid]; exists {
+		// DOWN of the previous monitor could come once the peer has been
+		// discovered again
+		if reflect.DeepEqual(p.ref, ref) {
+			delete(pg.remote, pid)
+		}
+		return
+	}
+	if !pg.monitored[pid] {
+		return
+	}
+	delete(pg.monitored, pid)
+	groups := etf.List{}
+	for key, g := range pg.local {
+		n := len(g.pids)
+		for i := 0; i < n; i++ {
+			g.pids = removePid(g.pids, pid)
+		}
+		if len(g.pids) == n {
+			continue
+		}
+		groups = append(groups, g.group)
+		if len(g.pids) == 0 {
+			delete(pg.local, key)
+		}
+	}
+	if len(groups) > 0 {
+		pg.broadcast(etf.Tuple{etf.Atom("leave"), pg.Self, pid, groups})
+	}
+}
+
+func (pg *pgScope) join(group etf.Term, pid etf.Pid) error {
+	if _, exists := pg.Node.getProcess(pid); !exists {
+		return ErrNoProc
+	}
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	key := termKey(group)
+	if _, exists := pg.local[key]; !exists {
+		pg.local[key] = &pgGroup{group: group}
+	}
+	pg.local[key].pids = append(pg.local[key].pids, pid)
+	if !pg.monitored[pid] {
+		pg.monitored[pid] = true
+		pg.Monitor(pid)
+	}
+	pg.broadcast(etf.Tuple{etf.Atom("join"), pg.Self, group, etf.List{pid}})
+	return nil
+}
+
+func (pg *pgScope) leave(group etf.Term, pid etf.Pid) error {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	key := termKey(group)
+	g, exists := pg.local[key]
+	if !exists {
+		return ErrNotJoined
+	}
+	n := len(g.pids)
+	if g.pids = removePid(g.pids, pid); len(g.pids) == n {
+		return ErrNotJoined
+	}
+	if len(g.pids) == 0 {
+		delete(pg.local, key)
+	}
+	pg.broadcast(etf.Tuple{etf.Atom("leave"), pg.Self, etf.List{pid}, etf.List{group}})
+	return nil
+}
+
+func (pg *pgScope) members(group etf.Term, remote bool) []etf.Pid {
+	pg.stateLock.Lock()
+	defer pg.stateLock.Unlock()
+	key := termKey(group)
+	var pids []etf.Pid
+	if g, exists := pg.local[key]; exists {
+		pids = append(pids, g.pids...)
+	}
+	if !remote {
+		return pids
+	}
+	for _, p := range pg.remote {
+		if g, exists := p.groups[key]; exists {
+			pids = append(pids, g.pids...)
+		}
+	}
+	return pids
+}
+
+// localGroups returns the local groups as [{Group, Pids}]. Must be called
+// with stateLock held
+func (pg *pgScope) localGroups() etf.List {
+	groups := etf.List{}
+	for _, g := range pg.local {
+		pids := etf.List{}
+		for _, pid := range g.pids {
+			pids = append(pids, pid)
+		}
+		groups = append(groups, etf.Tuple{g.group, pids})
+	}
+	return groups
+}
+
+// broadcast queues the message to all the peers. Must be called with
+// stateLock held
+func (pg *pgScope) broadcast(message etf.Term) {
+	for peer := range pg.remote {
+		pg.send(peer, message)
+	}
+}
+
+// send queues the message to the peer. Must be called with stateLock held
+func (pg *pgScope) send(peer etf.Pid, message etf.Term) {
+	pg.outbox.push([]etf.Term{peer, message})
+}
+
+// sender sends the queued messages to the peers until the scope exits
+func (pg *pgScope) sender() {
+	for {
+		select {
+		case <-pg.outbox.ready:
+		case <-pg.Context().Done():
+			return
+		}
+		for _, m := range pg.outbox.popAll() {
+			pg.Send(m[0].(etf.Pid), &m[1])
+		}
+	}
+}
+
+// monitorPeer monitors the added peer. It's called without stateLock held
+// since the monitor is sent to the node of the peer. DOWN is handled by the
+// scope itself, so it can't come before the ref is set
+func (pg *pgScope) monitorPeer(peer etf.Pid, p *pgPeer) {
+	ref := pg.Monitor(peer)
+	pg.stateLock.Lock()
+	p.ref = ref
+	pg.stateLock.Unlock()
+}
+
+// pgPids returns the pids of Pid or [Pid]
+func pgPids(t etf.Term) []etf.Pid {
+	if pid, ok := t.(etf.Pid); ok {
+		return []etf.Pid{pid}
+	}
+	var pids []etf.Pid
+	for _, p := range globalList(t) {
+		if pid, ok := p.(etf.Pid); ok {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
@@ -0,0 +1,117 @@
+package ergonode
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// waitMembers waits for the members of the group on the node to be equal to
+// the pids (in any order)
+func waitMembers(t *testing.T, node *Node, group etf.Term, pids ...etf.Pid) {
+	sortPids := func(p []etf.Pid) {
+		sort.Slice(p, func(i, j int) bool { return comparePids(p[i], p[j]) < 0 })
+	}
+	sortPids(pids)
+	var members []etf.Pid
+	for i := 0; i < 300; i++ {
+		members = node.GetMembers(group)
+		sortPids(members)
+		if len(members) == len(pids) && (len(pids) == 0 || reflect.DeepEqual(members, pids)) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: expected members %v of %v, got %v", node.FullName, pids, group, members)
+}
+
+func TestPgGroups(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+	group := etf.Atom("group")
+
+	pid1 := node1.Spawn(new(testEchoServer))
+	if err := node1.Join(group, pid1); err != nil {
+		t.Fatal(err)
+	}
+
+	// groups are synced once the scopes discover each other
+	if err := connect(context.Background(), node2, etf.Atom(node1.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitMembers(t, node2, group, pid1)
+
+	// joins and leaves are broadcasted to the peers
+	pid2 := node2.Spawn(new(testEchoServer))
+	node2.Join(group, pid2)
+	node2.Join(group, pid2)
+	waitMembers(t, node1, group, pid1, pid2, pid2)
+	if members := node2.GetLocalMembers(group); len(members) != 2 {
+		t.Fatalf("expected 2 local members, got %v", members)
+	}
+	if err := node2.Leave(group, pid2); err != nil {
+		t.Fatal(err)
+	}
+	waitMembers(t, node1, group, pid1, pid2)
+	if err := node2.Leave(etf.Atom("unknown"), pid2); err != ErrNotJoined {
+		t.Fatalf("expected %v, got %v", ErrNotJoined, err)
+	}
+	if err := node2.Join(group, pid1); err != ErrNoProc {
+		t.Fatalf("expected %v, got %v", ErrNoProc, err)
+	}
+
+	// exited process leaves all the groups
+	node1.Join(etf.Tuple{etf.Atom("other"), 1}, pid1)
+	waitMembers(t, node2, etf.Tuple{etf.Atom("other"), 1}, pid1)
+	node1.Exit(pid1, pid1, etf.Atom("kill"))
+	waitMembers(t, node2, group, pid2)
+	waitMembers(t, node2, etf.Tuple{etf.Atom("other"), 1})
+
+	// members of the disconnected node are removed and synced again on
+	// reconnect
+	disconnect(node1, node2)
+	waitMembers(t, node1, group)
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	waitMembers(t, node1, group, pid2)
+}
+
+// TestPgPeerMessages checks the messages sent to the peer by the scope
+func TestPgPeerMessages(t *testing.T) {
+	node := newPipeNode(t, "node1@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+	scope := node.sysProcs.pg.Self
+	group := etf.Atom("group")
+
+	peer := newTestInfoServer(false)
+	node.Spawn(peer)
+	discover := etf.Term(etf.Tuple{etf.Atom("discover"), peer.Self})
+	peer.Send(scope, &discover)
+	expect := func(expected etf.Term) {
+		if message := peer.waitInfo(t); !reflect.DeepEqual(message, expected) {
+			t.Fatalf("expected %#v, got %#v", expected, message)
+		}
+	}
+	expect(etf.Tuple{etf.Atom("sync"), scope, etf.List{}})
+	expect(etf.Tuple{etf.Atom("discover"), scope})
+
+	pid := node.Spawn(new(testEchoServer))
+	node.Join(group, pid)
+	expect(etf.Tuple{etf.Atom("join"), scope, group, etf.List{pid}})
+	node.Leave(group, pid)
+	expect(etf.Tuple{etf.Atom("leave"), scope, etf.List{pid}, etf.List{group}})
+
+	// process has left all its groups already. Nothing is sent on exit
+	node.Exit(pid, pid, etf.Atom("kill"))
+	select {
+	case message := <-peer.info:
+		t.Fatalf("unexpected message %#v", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
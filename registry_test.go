@@ -0,0 +1,86 @@
+package ergonode
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestRegister(t *testing.T) {
+	node := newPipeNode(t, "registry@localhost", "cookie", NodeOptions{})
+	defer node.Stop(context.Background())
+
+	gs1 := new(testEchoServer)
+	pid1 := node.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node.Spawn(gs2)
+
+	if err := node.Register("name1", pid1); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Register("name1", pid1); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Register("name1", pid2); err != ErrNameTaken {
+		t.Fatalf("expected %v, got %v", ErrNameTaken, err)
+	}
+	if err := node.Register("name2", pid1); err != ErrProcessNamed {
+		t.Fatalf("expected %v, got %v", ErrProcessNamed, err)
+	}
+	unknown := etf.Pid{Node: etf.Atom(node.FullName), Id: 12345}
+	if err := node.Register("name2", unknown); err != ErrNoProc {
+		t.Fatalf("expected %v, got %v", ErrNoProc, err)
+	}
+	if pid, exists := node.Whereis("name1"); !exists || pid != pid1 {
+		t.Fatalf("wrong pid of the registered name %v", pid)
+	}
+
+	// calls by the local name
+	message := etf.Term(etf.Atom("hello"))
+	if _, err := gs2.Call(etf.Atom("name1"), &message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs2.Call(etf.Atom("unknown"), &message, 1); err != ErrNoProc {
+		t.Fatalf("expected %v, got %v", ErrNoProc, err)
+	}
+
+	// name is released on exit
+	gs1.Stop(etf.Atom("normal"))
+	for i := 0; ; i++ {
+		if _, exists := node.Whereis("name1"); !exists {
+			break
+		}
+		if i == 100 {
+			t.Fatal("name hasn't been released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := node.Register("name1", pid2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendToUnknownName(t *testing.T) {
+	nodes := newPipeNodes(t, 2, NodeOptions{})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := new(testEchoServer)
+	pid1 := node1.Spawn(gs1)
+	pid2 := node2.Spawn(new(testEchoServer))
+
+	// messages are dropped by node2 without blocking the connection
+	to := etf.Tuple{etf.Atom("unknown"), etf.Atom(node2.FullName)}
+	for i := 0; i < 100; i++ {
+		message := etf.Term(i)
+		if err := node1.Send(pid1, to, &message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := etf.Term(etf.Atom("hello"))
+	if _, err := gs1.Call(pid2, &message); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -78,6 +78,6 @@ func (rpcs *rpcRex) HandleInfo(message *etf.Term, state interface{}) (code int,
 	return
 }
 
-func (rpcs *rpcRex) Terminate(reason int, state interface{}) {
+func (rpcs *rpcRex) Terminate(reason etf.Term, state interface{}) {
 	lib.Log("REX: Terminate: %#v", reason)
 }
@@ -0,0 +1,461 @@
+package ergonode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+	"github.com/halturin/ergonode/lib"
+)
+
+// Supervisor restart strategies (http://erlang.org/doc/design_principles/sup_princ.html)
+const (
+	// SupervisorStrategyOneForOne restarts the terminated child only
+	SupervisorStrategyOneForOne = "one_for_one"
+	// SupervisorStrategyOneForAll terminates all the other children and
+	// then restarts all of them
+	SupervisorStrategyOneForAll = "one_for_all"
+	// SupervisorStrategyRestForOne terminates the children started after
+	// the terminated one and then restarts all of them
+	SupervisorStrategyRestForOne = "rest_for_one"
+	// SupervisorStrategySimpleOneForOne is a simplified one_for_one where all
+	// the children are dynamically added instances of the same process
+	SupervisorStrategySimpleOneForOne = "simple_one_for_one"
+)
+
+// Supervisor child restart types
+const (
+	// SupervisorChildRestartPermanent child is always restarted
+	SupervisorChildRestartPermanent = "permanent"
+	// SupervisorChildRestartTransient child is restarted only if it
+	// terminates abnormally (reason other than normal, shutdown or {shutdown, Term})
+	SupervisorChildRestartTransient = "transient"
+	// SupervisorChildRestartTemporary child is never restarted
+	SupervisorChildRestartTemporary = "temporary"
+)
+
+// SupervisorInt interface
+type SupervisorInt interface {
+	// Init(...) -> spec
+	Init(args ...interface{}) SupervisorSpec
+}
+
+// SupervisorSpec describes children and restart strategy of the supervisor
+type SupervisorSpec struct {
+	Children []SupervisorChildSpec
+	Strategy SupervisorStrategy
+}
+
+// SupervisorStrategy defines restart strategy and restart intensity: if more
+// than Intensity restarts occur within Period seconds, the supervisor
+// terminates all the children and then itself with reason 'shutdown'.
+// Zero Intensity and Period mean the defaults of OTP: 1 restart in 5 seconds
+// (set Period only to disable the restarts)
+type SupervisorStrategy struct {
+	Type      string
+	Intensity uint16
+	Period    uint16
+}
+
+// SupervisorChildSpec describes the child process
+type SupervisorChildSpec struct {
+	Name string
+	// Child is the process to start. It must be a pointer. Restarted children
+	// (and every child of simple_one_for_one supervisor) are the copies of
+	// Child made before the first start, so the fields set on it are kept
+	Child Process
+	// NewChild makes a new instance of the child on every (re)start. Child
+	// isn't used if it's set
+	NewChild func() Process
+	Args     []interface{}
+	Restart  string
+	// Shutdown is the time (in seconds) to wait for the child to exit after
+	// 'shutdown' exit signal before it gets killed. Default is 5 seconds
+	Shutdown int
+}
+
+// Supervisor is implementation of SupervisorInt interface
+type Supervisor struct {
+	Node *Node   // current node of process
+	Self etf.Pid // Pid of process
+
+	spec     SupervisorSpec
+	children []*supervisorChild
+	restarts []time.Time
+	template Process // copy of the child of simple_one_for_one supervisor
+	pending  []procExit
+	startReq chan supervisorStartReq
+	done     chan struct{} // closed once the supervisor has exited
+	context  context.Context
+}
+
+type supervisorChild struct {
+	spec     SupervisorChildSpec
+	process  Process
+	template Process // copy of spec.Child made before the first start
+	args     []interface{}
+	pid      etf.Pid
+	started  bool // process has been started at least once
+}
+
+type supervisorStartReq struct {
+	args  []interface{}
+	reply chan supervisorStartReply
+}
+
+type supervisorStartReply struct {
+	pid etf.Pid
+	err error
+}
+
+// Options returns map of default process-related options
+func (sv *Supervisor) Options() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+// ProcessLoop executes during whole time of process life.
+// It starts the children, watches them through the links and restarts
+// them according to the strategy
+func (sv *Supervisor) ProcessLoop(pcs procChannels, pd Process, args ...interface{}) {
+	var exitReason etf.Term = etf.Atom("normal")
+	initialized := false
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Supervisor recovered: %#v", r)
+			exitReason = etf.Tuple{etf.Atom("panic"), fmt.Sprint(r)}
+		}
+		if !initialized {
+			pcs.init <- false
+		}
+		close(sv.done)
+		sv.Node.processExited(sv.Self, exitReason)
+	}()
+
+	sv.context = pcs.context
+	sv.spec = pd.(SupervisorInt).Init(args...)
+	lib.Log("SUPERVISOR %#v: spec %#v", sv.Self, sv.spec)
+	if sv.spec.Strategy.Intensity == 0 && sv.spec.Strategy.Period == 0 {
+		sv.spec.Strategy.Intensity = 1
+		sv.spec.Strategy.Period = 5
+	}
+
+	if sv.spec.Strategy.Type == SupervisorStrategySimpleOneForOne {
+		if len(sv.spec.Children) != 1 {
+			panic("simple_one_for_one supervisor requires exactly one child spec")
+		}
+		sv.template = childTemplate(sv.spec.Children[0])
+	} else {
+		for i := range sv.spec.Children {
+			child := &supervisorChild{
+				spec:     sv.spec.Children[i],
+				template: childTemplate(sv.spec.Children[i]),
+				args:     sv.spec.Children[i].Args,
+			}
+			if child.spec.NewChild == nil {
+				child.process = child.spec.Child
+			}
+			sv.children = append(sv.children, child)
+			sv.startChild(child)
+		}
+	}
+
+	initialized = true
+	pcs.init <- true
+
+	for {
+		var ex procExit
+
+		if len(sv.pending) > 0 {
+			ex, sv.pending = sv.pending[0], sv.pending[1:]
+		} else {
+			select {
+			case ex = <-pcs.exit:
+			case <-pcs.context.Done():
+				lib.Log("SUPERVISOR %#v: context is done. Stopping", sv.Self)
+				sv.stopChildren(pcs)
+				exitReason = etf.Atom("shutdown")
+				return
+			case req := <-sv.startReq:
+				if sv.spec.Strategy.Type != SupervisorStrategySimpleOneForOne {
+					req.reply <- supervisorStartReply{
+						err: errors.New("StartChild is allowed for simple_one_for_one supervisor only"),
+					}
+					continue
+				}
+				child := &supervisorChild{
+					spec:     sv.spec.Children[0],
+					template: sv.template,
+					args:     append(append([]interface{}{}, sv.spec.Children[0].Args...), req.args...),
+				}
+				sv.children = append(sv.children, child)
+				sv.startChild(child)
+				req.reply <- supervisorStartReply{pid: child.pid}
+				continue
+			case <-pcs.mailbox.ready:
+				if m, ok := pcs.mailbox.pop(); ok {
+					lib.Log("SUPERVISOR %#v: unexpected message %#v", sv.Self, m.message)
+				}
+				continue
+			}
+		}
+
+		if ex.kill {
+			sv.terminateChildren(pcs, sv.children)
+			exitReason = etf.Atom("killed")
+			return
+		}
+
+		i := sv.childIndex(ex.from)
+		if i < 0 {
+			// exit signal from the parent or some other linked process
+			if ex.reason == etf.Atom("normal") {
+				continue
+			}
+			lib.Log("SUPERVISOR %#v: exit signal from %#v (%#v). Stopping", sv.Self, ex.from, ex.reason)
+			sv.terminateChildren(pcs, sv.children)
+			exitReason = ex.reason
+			return
+		}
+
+		if pcs.context.Err() != nil {
+			// children are stopping by themselves. Do not restart them
+			sv.children[i].pid = etf.Pid{}
+			sv.stopChildren(pcs)
+			exitReason = etf.Atom("shutdown")
+			return
+		}
+
+		if !sv.handleChildExit(pcs, i, ex.reason) {
+			log.Printf("Supervisor %#v: reached max restart intensity", sv.Self)
+			sv.terminateChildren(pcs, sv.children)
+			exitReason = etf.Atom("shutdown")
+			return
+		}
+	}
+}
+
+// StartChild dynamically starts the child of simple_one_for_one supervisor.
+// Given args are appended to the args of the child spec. Returns error if
+// the supervisor isn't running
+func (sv *Supervisor) StartChild(args ...interface{}) (etf.Pid, error) {
+	if sv.startReq == nil {
+		return etf.Pid{}, errors.New("supervisor hasn't been started")
+	}
+	req := supervisorStartReq{
+		args:  args,
+		reply: make(chan supervisorStartReply, 1),
+	}
+	select {
+	case sv.startReq <- req:
+	case <-sv.done:
+		return etf.Pid{}, errors.New("supervisor is not running")
+	}
+	reply := <-req.reply
+	return reply.pid, reply.err
+}
+
+func (sv *Supervisor) setNode(node *Node) {
+	sv.Node = node
+}
+
+func (sv *Supervisor) setPid(pid etf.Pid) {
+	sv.Self = pid
+	// made before the process loop is started, so StartChild could be
+	// called right after Spawn
+	sv.startReq = make(chan supervisorStartReq)
+	sv.done = make(chan struct{})
+}
+
+// handleChildExit restarts children according to the strategy. Returns false
+// if the restart intensity has been exceeded
+func (sv *Supervisor) handleChildExit(pcs procChannels, i int, reason etf.Term) bool {
+	child := sv.children[i]
+	child.pid = etf.Pid{}
+	lib.Log("SUPERVISOR %#v: child %q exited with reason %#v", sv.Self, child.spec.Name, reason)
+
+	if !needRestart(child.spec.Restart, reason) {
+		if sv.spec.Strategy.Type == SupervisorStrategySimpleOneForOne ||
+			child.spec.Restart == SupervisorChildRestartTemporary {
+			sv.children = append(sv.children[:i], sv.children[i+1:]...)
+		}
+		return true
+	}
+
+	if !sv.addRestart() {
+		return false
+	}
+
+	switch sv.spec.Strategy.Type {
+	case SupervisorStrategyOneForAll:
+		sv.terminateChildren(pcs, sv.children)
+		for _, c := range sv.children {
+			sv.startChild(c)
+		}
+
+	case SupervisorStrategyRestForOne:
+		rest := sv.children[i+1:]
+		sv.terminateChildren(pcs, rest)
+		for _, c := range sv.children[i:] {
+			sv.startChild(c)
+		}
+
+	default:
+		// one_for_one, simple_one_for_one
+		sv.startChild(child)
+	}
+
+	return true
+}
+
+// addRestart registers a restart and checks the restart intensity
+func (sv *Supervisor) addRestart() bool {
+	now := time.Now()
+	period := time.Duration(sv.spec.Strategy.Period) * time.Second
+
+	restarts := sv.restarts[:0]
+	for _, t := range sv.restarts {
+		if now.Sub(t) <= period {
+			restarts = append(restarts, t)
+		}
+	}
+	sv.restarts = append(restarts, now)
+
+	return len(sv.restarts) <= int(sv.spec.Strategy.Intensity)
+}
+
+func (sv *Supervisor) startChild(child *supervisorChild) {
+	if child.started || child.process == nil {
+		// goroutines of the previous instance could be still running.
+		// Never reuse it
+		child.process = child.newProcess()
+	}
+	child.started = true
+	child.pid = sv.Node.SpawnContext(sv.context, child.process, child.args...)
+	sv.Node.Link(sv.Self, child.pid)
+	lib.Log("SUPERVISOR %#v: started child %q: %#v", sv.Self, child.spec.Name, child.pid)
+}
+
+// terminateChildren terminates given children in reverse start order
+func (sv *Supervisor) terminateChildren(pcs procChannels, children []*supervisorChild) {
+	for i := len(children) - 1; i >= 0; i-- {
+		sv.terminateChild(pcs, children[i], etf.Atom("shutdown"))
+	}
+}
+
+// stopChildren waits for the children to exit once the context is done (the
+// context of children is done as well, so they are stopping by themselves)
+func (sv *Supervisor) stopChildren(pcs procChannels) {
+	for i := len(sv.children) - 1; i >= 0; i-- {
+		sv.terminateChild(pcs, sv.children[i], nil)
+	}
+}
+
+// terminateChild sends exit signal with given reason ('shutdown') to the
+// child and waits for its exit. The child gets killed if it doesn't exit in
+// time. Exit signal isn't sent if the reason is nil
+func (sv *Supervisor) terminateChild(pcs procChannels, child *supervisorChild, reason etf.Term) {
+	if child.pid == (etf.Pid{}) {
+		return
+	}
+
+	for i, ex := range sv.pending {
+		if ex.from == child.pid {
+			// has already exited
+			sv.pending = append(sv.pending[:i], sv.pending[i+1:]...)
+			child.pid = etf.Pid{}
+			return
+		}
+	}
+
+	shutdown := child.spec.Shutdown
+	if shutdown <= 0 {
+		shutdown = 5
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if reason != nil {
+			sv.Node.Exit(sv.Self, child.pid, reason)
+		}
+		timeout := time.After(time.Duration(shutdown) * time.Second)
+	wait:
+		for {
+			select {
+			case ex := <-pcs.exit:
+				if ex.from == child.pid {
+					child.pid = etf.Pid{}
+					return
+				}
+				// handle it later
+				sv.pending = append(sv.pending, ex)
+			case <-timeout:
+				break wait
+			}
+		}
+		lib.Log("SUPERVISOR %#v: child %q doesn't exit. Killing", sv.Self, child.spec.Name)
+		reason = etf.Atom("kill")
+	}
+
+	log.Printf("Supervisor %#v: can't terminate child %q (%#v)", sv.Self, child.spec.Name, child.pid)
+	sv.Node.Unlink(sv.Self, child.pid)
+	child.pid = etf.Pid{}
+}
+
+func (sv *Supervisor) childIndex(pid etf.Pid) int {
+	for i, c := range sv.children {
+		if c.pid == pid {
+			return i
+		}
+	}
+	return -1
+}
+
+// needRestart checks whether the child with given restart type should be
+// restarted after its exit with the reason
+func needRestart(restart string, reason etf.Term) bool {
+	switch restart {
+	case SupervisorChildRestartTemporary:
+		return false
+	case SupervisorChildRestartTransient:
+		switch r := reason.(type) {
+		case etf.Atom:
+			return r != etf.Atom("normal") && r != etf.Atom("shutdown")
+		case etf.Tuple:
+			return !(len(r) == 2 && r[0] == etf.Atom("shutdown"))
+		}
+		return true
+	}
+	// permanent
+	return true
+}
+
+// newProcess makes a new instance of the child
+func (c *supervisorChild) newProcess() Process {
+	if c.spec.NewChild != nil {
+		return c.spec.NewChild()
+	}
+	return copyProcess(c.template)
+}
+
+// childTemplate copies the child of the spec before it has been started.
+// Returns nil if the spec has NewChild
+func childTemplate(spec SupervisorChildSpec) Process {
+	if spec.NewChild != nil {
+		return nil
+	}
+	if v := reflect.ValueOf(spec.Child); v.Kind() != reflect.Ptr || v.IsNil() {
+		panic(fmt.Sprintf("child %q: Child must be a pointer unless NewChild is set", spec.Name))
+	}
+	return copyProcess(spec.Child)
+}
+
+// copyProcess makes a shallow copy of the process (pointer to struct)
+func copyProcess(p Process) Process {
+	v := reflect.ValueOf(p).Elem()
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	return c.Interface().(Process)
+}
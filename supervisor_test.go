@@ -0,0 +1,280 @@
+package ergonode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// testSupChild registers itself with the name given as the first argument
+type testSupChild struct {
+	testEchoServer
+}
+
+func (gs *testSupChild) Init(args ...interface{}) (state interface{}) {
+	gs.Node.Register(args[0].(etf.Atom), gs.Self)
+	return nil
+}
+
+type testSup struct {
+	Supervisor
+	strategy SupervisorStrategy
+	children []string
+}
+
+func (sv *testSup) Init(args ...interface{}) SupervisorSpec {
+	spec := SupervisorSpec{Strategy: sv.strategy}
+	if sv.strategy.Type == SupervisorStrategySimpleOneForOne {
+		// the name is given to StartChild
+		spec.Children = []SupervisorChildSpec{{
+			Name:    "dynamic",
+			Child:   &testSupChild{},
+			Restart: SupervisorChildRestartPermanent,
+		}}
+		return spec
+	}
+	for _, name := range sv.children {
+		spec.Children = append(spec.Children, SupervisorChildSpec{
+			Name:    name,
+			Child:   &testSupChild{},
+			Args:    []interface{}{etf.Atom(name)},
+			Restart: SupervisorChildRestartPermanent,
+		})
+	}
+	return spec
+}
+
+// waitChild waits for the process registered with the name to differ from
+// the given pid (empty pid waits for any)
+func waitChild(t *testing.T, node *Node, name etf.Atom, old etf.Pid) etf.Pid {
+	for i := 0; i < 100; i++ {
+		if pid, exists := node.Whereis(name); exists && pid != old {
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("child %s hasn't been (re)started", name)
+	return etf.Pid{}
+}
+
+func childPids(t *testing.T, node *Node, names ...etf.Atom) []etf.Pid {
+	pids := make([]etf.Pid, len(names))
+	for i, name := range names {
+		pids[i] = waitChild(t, node, name, etf.Pid{})
+	}
+	return pids
+}
+
+func TestSupervisorStrategies(t *testing.T) {
+	node := newPipeNode(t, "sup@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+
+	names := []etf.Atom{"child_a", "child_b", "child_c"}
+	cases := []struct {
+		strategy  string
+		restarted []bool // which children get new pids once child_b is killed
+	}{
+		{SupervisorStrategyOneForOne, []bool{false, true, false}},
+		{SupervisorStrategyOneForAll, []bool{true, true, true}},
+		{SupervisorStrategyRestForOne, []bool{false, true, true}},
+	}
+	for _, c := range cases {
+		sup := &testSup{
+			strategy: SupervisorStrategy{Type: c.strategy, Intensity: 10, Period: 5},
+			children: []string{"child_a", "child_b", "child_c"},
+		}
+		supPid := node.Spawn(sup)
+		before := childPids(t, node, names...)
+
+		node.Exit(supPid, before[1], etf.Atom("kill"))
+		for i := range names {
+			if c.restarted[i] {
+				waitChild(t, node, names[i], before[i])
+			}
+		}
+		for i := range names {
+			if pid, _ := node.Whereis(names[i]); !c.restarted[i] && pid != before[i] {
+				t.Fatalf("%s: child %s has been restarted", c.strategy, names[i])
+			}
+		}
+
+		node.Exit(supPid, supPid, etf.Atom("kill"))
+		for _, name := range names {
+			for i := 0; ; i++ {
+				if _, exists := node.Whereis(name); !exists {
+					break
+				}
+				if i == 100 {
+					t.Fatalf("%s: child %s is still alive", c.strategy, name)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestSupervisorSimpleOneForOne(t *testing.T) {
+	node := newPipeNode(t, "sup@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+
+	sup := &testSup{
+		strategy: SupervisorStrategy{Type: SupervisorStrategySimpleOneForOne, Intensity: 10, Period: 5},
+	}
+	supPid := node.Spawn(sup)
+
+	pid1, err := sup.StartChild(etf.Atom("dynamic_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid2, err := sup.StartChild(etf.Atom("dynamic_2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node.Exit(supPid, pid1, etf.Atom("kill"))
+	waitChild(t, node, "dynamic_1", pid1)
+	if pid, _ := node.Whereis("dynamic_2"); pid != pid2 {
+		t.Fatalf("child dynamic_2 has been restarted")
+	}
+
+	node.Exit(supPid, supPid, etf.Atom("kill"))
+	for i := 0; ; i++ {
+		if _, err := sup.StartChild(etf.Atom("dynamic_3")); err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("StartChild of the stopped supervisor has succeeded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sup = &testSup{
+		strategy: SupervisorStrategy{Type: SupervisorStrategyOneForOne, Intensity: 10, Period: 5},
+	}
+	node.Spawn(sup)
+	if _, err := sup.StartChild(); err == nil {
+		t.Fatal("StartChild of one_for_one supervisor has succeeded")
+	}
+}
+
+func TestSupervisorIntensity(t *testing.T) {
+	node := newPipeNode(t, "sup@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+
+	sup := &testSup{
+		strategy: SupervisorStrategy{Type: SupervisorStrategyOneForOne, Intensity: 2, Period: 5},
+		children: []string{"child_a", "child_b"},
+	}
+	supPid := node.Spawn(sup)
+
+	// 2 restarts within the period are allowed
+	for i := 0; i < 2; i++ {
+		pid := waitChild(t, node, "child_a", etf.Pid{})
+		node.Exit(supPid, pid, etf.Atom("kill"))
+		waitChild(t, node, "child_a", pid)
+	}
+	if _, exists := node.getProcess(supPid); !exists {
+		t.Fatal("supervisor has exited")
+	}
+
+	// the 3rd one exceeds the intensity
+	pid, _ := node.Whereis("child_a")
+	node.Exit(supPid, pid, etf.Atom("kill"))
+	for i := 0; ; i++ {
+		_, supAlive := node.getProcess(supPid)
+		_, childAlive := node.Whereis("child_b")
+		if !supAlive && !childAlive {
+			break
+		}
+		if i == 100 {
+			t.Fatal("supervisor hasn't given up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testSupConfigChild replies on the calls with the configured value
+type testSupConfigChild struct {
+	testSupChild
+	value etf.Atom
+}
+
+func (gs *testSupConfigChild) HandleCall(from *etf.Tuple, message *etf.Term, state interface{}) (int, *etf.Term, interface{}) {
+	reply := etf.Term(gs.value)
+	return 1, &reply, state
+}
+
+type testSupSpec struct {
+	Supervisor
+	initSpec SupervisorSpec
+}
+
+func (sv *testSupSpec) Init(args ...interface{}) SupervisorSpec {
+	return sv.initSpec
+}
+
+func TestSupervisorChildConfig(t *testing.T) {
+	node := newPipeNode(t, "sup@localhost", "cookie", NodeOptions{})
+	defer stopNodes([]*Node{node})
+
+	caller := new(testEchoServer)
+	node.Spawn(caller)
+	checkValue := func(name, value etf.Atom) {
+		message := etf.Term(etf.Atom("value"))
+		reply, err := caller.Call(name, &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *reply != value {
+			t.Fatalf("%s: expected %v, got %v", name, value, *reply)
+		}
+	}
+
+	// zero strategy allows 1 restart in 5 seconds
+	sup := &testSupSpec{initSpec: SupervisorSpec{
+		Strategy: SupervisorStrategy{Type: SupervisorStrategyOneForOne},
+		Children: []SupervisorChildSpec{
+			{
+				Name:    "configured",
+				Child:   &testSupConfigChild{value: "configured"},
+				Args:    []interface{}{etf.Atom("configured")},
+				Restart: SupervisorChildRestartPermanent,
+			},
+			{
+				Name: "factory",
+				NewChild: func() Process {
+					return &testSupConfigChild{value: "factory"}
+				},
+				Args:    []interface{}{etf.Atom("factory")},
+				Restart: SupervisorChildRestartPermanent,
+			},
+		},
+	}}
+	supPid := node.Spawn(sup)
+	pids := childPids(t, node, "configured", "factory")
+	node.Exit(supPid, pids[0], etf.Atom("kill"))
+	waitChild(t, node, "configured", pids[0])
+	checkValue("configured", "configured")
+	checkValue("factory", "factory")
+	if _, exists := node.getProcess(supPid); !exists {
+		t.Fatal("supervisor has exited")
+	}
+
+	simple := &testSupSpec{initSpec: SupervisorSpec{
+		Strategy: SupervisorStrategy{Type: SupervisorStrategySimpleOneForOne},
+		Children: []SupervisorChildSpec{{
+			Name:    "dynamic",
+			Child:   &testSupConfigChild{value: "dynamic"},
+			Restart: SupervisorChildRestartPermanent,
+		}},
+	}}
+	node.Spawn(simple)
+	pid, err := simple.StartChild(etf.Atom("dynamic_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Exit(pid, pid, etf.Atom("kill"))
+	waitChild(t, node, "dynamic_1", pid)
+	checkValue("dynamic_1", "dynamic")
+}
@@ -0,0 +1,103 @@
+package ergonode
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestTickTime(t *testing.T) {
+	opts := NodeOptions{Transport: NewPipeTransport(), TickTime: 1}
+	nodes := newPipeNodes(t, 2, opts)
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	// idle connection is kept alive by the ticks
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	if nodes := node1.Nodes(); len(nodes) != 1 {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+
+	// node3 doesn't send ticks within the tick time of node1
+	opts.TickTime = 3600
+	node3 := newPipeNode(t, "node3@localhost", "cookie", opts)
+	defer node3.Stop(context.Background())
+	if err := connect(context.Background(), node1, etf.Atom(node3.FullName)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if nodes := node1.Nodes(); len(nodes) != 1 || nodes[0] != etf.Atom(node2.FullName) {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+	if nodes := node3.Nodes(); len(nodes) != 0 {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+}
+
+// testSerialConn flags the concurrent writes. Writes (except the ticks) are
+// slow once 'slow' is set, so the ticker has a chance to write in between
+type testSerialConn struct {
+	net.Conn
+	writing    int32
+	concurrent *int32
+	slow       *int32
+}
+
+func (c *testSerialConn) Write(b []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		atomic.StoreInt32(c.concurrent, 1)
+	}
+	defer atomic.StoreInt32(&c.writing, 0)
+	if len(b) > 4 && atomic.LoadInt32(c.slow) == 1 {
+		time.Sleep(time.Second)
+	}
+	return c.Conn.Write(b)
+}
+
+// testSerialTransport makes the outgoing connections which flag the
+// concurrent writes
+type testSerialTransport struct {
+	*PipeTransport
+	concurrent int32
+	slow       int32
+}
+
+func (t *testSerialTransport) Dial(ctx context.Context, name string, address string) (net.Conn, error) {
+	c, err := t.PipeTransport.Dial(ctx, name, address)
+	if err != nil {
+		return nil, err
+	}
+	return &testSerialConn{Conn: c, concurrent: &t.concurrent, slow: &t.slow}, nil
+}
+
+func TestTicksAreSerialized(t *testing.T) {
+	transport := &testSerialTransport{PipeTransport: NewPipeTransport()}
+	nodes := newPipeNodes(t, 2, NodeOptions{Transport: transport, TickTime: 1})
+	defer stopNodes(nodes)
+	node1, node2 := nodes[0], nodes[1]
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	pid2 := node2.Spawn(new(testEchoServer))
+	if err := connect(context.Background(), node1, etf.Atom(node2.FullName)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ticker checks the connection every 250ms while the slow write of
+	// the message is in progress
+	message := etf.Term(etf.Atom("hello"))
+	atomic.StoreInt32(&transport.slow, 1)
+	gs1.Send(pid2, &message)
+	time.Sleep(1500 * time.Millisecond)
+	atomic.StoreInt32(&transport.slow, 0)
+	if atomic.LoadInt32(&transport.concurrent) != 0 {
+		t.Fatal("ticks have been written concurrently with the messages")
+	}
+}
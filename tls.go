@@ -0,0 +1,129 @@
+package ergonode
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/halturin/ergonode/lib"
+)
+
+// NodeTLSOptions defines TLS distribution options (like -proto_dist inet_tls)
+type NodeTLSOptions struct {
+	// CertFile and KeyFile are PEM encoded certificate and private key of
+	// the node. They are used for both incoming and outgoing connections
+	CertFile string
+	KeyFile  string
+	// CAFile is PEM encoded CA certificates to verify the remote nodes.
+	// Certificate of the remote node isn't verified if it's empty (like
+	// verify_none does in Erlang)
+	CAFile string
+	// VerifyClientCert requires the nodes connecting to this one to present
+	// the certificate signed by CA (CAFile is required)
+	VerifyClientCert bool
+}
+
+// TLSTransport is TCPTransport with TLS on top of the connections
+type TLSTransport struct {
+	TCPTransport
+	server *tls.Config
+	client *tls.Config
+}
+
+// NewTLSTransport makes TLS transport with the given certificates
+func NewTLSTransport(opts NodeTLSOptions) (*TLSTransport, error) {
+	server, client, err := tlsConfigs(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return &TLSTransport{server: server, client: client}, nil
+}
+
+// Listen implements Transport interface
+func (t *TLSTransport) Listen(ctx context.Context, name string, opts NodeOptions) (net.Listener, uint16, error) {
+	l, port, err := t.TCPTransport.Listen(ctx, name, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tls.NewListener(l, t.server), port, nil
+}
+
+// Dial implements Transport interface
+func (t *TLSTransport) Dial(ctx context.Context, name string, address string) (net.Conn, error) {
+	c, err := t.TCPTransport.Dial(ctx, name, address)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = dialTLS(ctx, c, t.client, name); err != nil {
+		lib.Log("Error connecting to %s: %s", name, err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsConfigs makes configuration for the listener (server) and for the
+// outgoing connections (client)
+func tlsConfigs(opts *NodeTLSOptions) (server *tls.Config, client *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't load TLS certificate: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Can't read CA file: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("Can't load CA certificates from %s", opts.CAFile)
+		}
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if opts.VerifyClientCert {
+		if pool == nil {
+			return nil, nil, errors.New("CA file is required to verify client certificates")
+		}
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		server.ClientCAs = pool
+	}
+
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		// server name is set for every connection (host part of the node name)
+		InsecureSkipVerify: pool == nil,
+	}
+
+	return server, client, nil
+}
+
+// dialTLS makes TLS handshake over the given connection to the node 'to'.
+// Handshake is aborted once the context is done
+func dialTLS(ctx context.Context, c net.Conn, config *tls.Config, to string) (net.Conn, error) {
+	config = config.Clone()
+	if ns := strings.Split(to, "@"); len(ns) == 2 {
+		config.ServerName = ns[1]
+	}
+
+	tc := tls.Client(c, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(deadline)
+	}
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
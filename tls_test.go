@@ -0,0 +1,197 @@
+package ergonode
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+// writeSelfSignedCert generates self-signed certificate for localhost and
+// returns paths to the certificate and the private key
+func writeSelfSignedCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func testTLSCall(t *testing.T, epmdPort uint16, opts1, opts2 NodeOptions) error {
+	opts1.EPMDPort = epmdPort
+	opts2.EPMDPort = epmdPort
+	opts1.ListenRangeBegin, opts1.ListenRangeEnd = 26000, 26100
+	opts2.ListenRangeBegin, opts2.ListenRangeEnd = 26000, 26100
+	opts1.CallTimeout = 2
+
+	node1, err := Create("tls1@127.0.0.1", "cookie", opts1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node1.Stop(context.Background())
+	node2, err := Create("tls2@127.0.0.1", "cookie", opts2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node2.Stop(context.Background())
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+
+	message := etf.Term(etf.Atom("hello"))
+	reply, err := gs1.Call(pid2, &message)
+	if err != nil {
+		return err
+	}
+	if *reply != message {
+		t.Fatalf("expected %#v, got %#v", message, *reply)
+	}
+	return nil
+}
+
+func TestTLSDistribution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ergonode-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeSelfSignedCert(t, dir, "node")
+
+	// verify both server and client certificates
+	tlsOpts := &NodeTLSOptions{
+		CertFile:         cert,
+		KeyFile:          key,
+		CAFile:           cert,
+		VerifyClientCert: true,
+	}
+	opts := NodeOptions{TLS: tlsOpts}
+	if err := testTLSCall(t, 14401, opts, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// certificates are not verified without CA
+	opts = NodeOptions{TLS: &NodeTLSOptions{CertFile: cert, KeyFile: key}}
+	if err := testTLSCall(t, 14402, opts, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSUntrustedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ergonode-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeSelfSignedCert(t, dir, "node")
+	otherCert, otherKey := writeSelfSignedCert(t, dir, "other")
+
+	server := NodeOptions{TLS: &NodeTLSOptions{
+		CertFile:         cert,
+		KeyFile:          key,
+		CAFile:           cert,
+		VerifyClientCert: true,
+	}}
+
+	// client certificate isn't signed by CA of the server
+	client := NodeOptions{TLS: &NodeTLSOptions{
+		CertFile: otherCert,
+		KeyFile:  otherKey,
+	}}
+	if err := testTLSCall(t, 14403, client, server); err == nil {
+		t.Fatal("connection with untrusted client certificate has been accepted")
+	}
+
+	// server certificate isn't signed by CA of the client
+	client = NodeOptions{TLS: &NodeTLSOptions{
+		CertFile: otherCert,
+		KeyFile:  otherKey,
+		CAFile:   otherCert,
+	}}
+	server = NodeOptions{TLS: &NodeTLSOptions{CertFile: cert, KeyFile: key}}
+	if err := testTLSCall(t, 14404, client, server); err == nil {
+		t.Fatal("connection with untrusted server certificate has been made")
+	}
+}
+
+func TestTLSPlainNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ergonode-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeSelfSignedCert(t, dir, "node")
+
+	server := NodeOptions{TLS: &NodeTLSOptions{CertFile: cert, KeyFile: key}}
+	if err := testTLSCall(t, 14405, NodeOptions{}, server); err == nil {
+		t.Fatal("plain connection to TLS node has been made")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ergonode-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeSelfSignedCert(t, dir, "node")
+
+	wrong := []NodeTLSOptions{
+		{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: key},
+		{CertFile: cert, KeyFile: key, CAFile: filepath.Join(dir, "missing.pem")},
+		{CertFile: cert, KeyFile: key, CAFile: key},
+		{CertFile: cert, KeyFile: key, VerifyClientCert: true},
+	}
+	for i := range wrong {
+		opts := NodeOptions{TLS: &wrong[i], EPMDPort: 14406}
+		if node, err := Create("tls@127.0.0.1", "cookie", opts); err == nil {
+			node.Stop(context.Background())
+			t.Errorf("wrong TLS options %#v are accepted", wrong[i])
+		}
+	}
+}
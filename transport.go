@@ -0,0 +1,175 @@
+package ergonode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/halturin/ergonode/dist"
+	"github.com/halturin/ergonode/lib"
+)
+
+// Transport defines how the node accepts and makes the distribution
+// connections. Create and outgoing connections go through it
+type Transport interface {
+	// Listen starts listening for the connections to the node 'name'.
+	// Returned port is registered on EPMD. Node isn't registered on EPMD
+	// if the port is 0
+	Listen(ctx context.Context, name string, opts NodeOptions) (net.Listener, uint16, error)
+	// Resolve returns the address of the node 'name' to dial
+	Resolve(ctx context.Context, name string, opts NodeOptions) (string, error)
+	// Dial makes the connection to the node 'name' by the resolved address
+	Dial(ctx context.Context, name string, address string) (net.Conn, error)
+}
+
+// TCPTransport is the default transport. Node listens on the first free port
+// of the range ListenRangeBegin...ListenRangeEnd. Ports of the remote nodes
+// are resolved via EPMD
+type TCPTransport struct{}
+
+// Listen implements Transport interface
+func (t TCPTransport) Listen(ctx context.Context, name string, opts NodeOptions) (net.Listener, uint16, error) {
+	var lc net.ListenConfig
+	for p := opts.ListenRangeBegin; ; p++ {
+		l, err := lc.Listen(ctx, "tcp", net.JoinHostPort("", strconv.Itoa(int(p))))
+		if err == nil {
+			return l, p, nil
+		}
+		if p == opts.ListenRangeEnd {
+			return nil, 0, fmt.Errorf("Can't listen port in range %d...%d", opts.ListenRangeBegin, opts.ListenRangeEnd)
+		}
+	}
+}
+
+// Resolve implements Transport interface
+func (t TCPTransport) Resolve(ctx context.Context, name string, opts NodeOptions) (string, error) {
+	port, err := dist.ResolveNodePort(ctx, name, opts.EPMDPort)
+	if port < 0 {
+		return "", fmt.Errorf("Can't resolve port: %s", err)
+	}
+	ns := strings.Split(name, "@")
+	return net.JoinHostPort(ns[1], strconv.Itoa(port)), nil
+}
+
+// Dial implements Transport interface
+func (t TCPTransport) Dial(ctx context.Context, name string, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		lib.Log("Error calling net.Dial : %s", err.Error())
+		return nil, err
+	}
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+	}
+	return c, nil
+}
+
+// PipeTransport connects the nodes of the same process via net.Pipe. It
+// doesn't use ports and EPMD. Nodes are able to connect to each other if
+// they share the same PipeTransport
+type PipeTransport struct {
+	mtx       sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+// NewPipeTransport creates in-process transport
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{
+		listeners: make(map[string]*pipeListener),
+	}
+}
+
+// Listen implements Transport interface
+func (t *PipeTransport) Listen(ctx context.Context, name string, opts NodeOptions) (net.Listener, uint16, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, exists := t.listeners[name]; exists {
+		return nil, 0, fmt.Errorf("Node %s is already listening", name)
+	}
+	l := &pipeListener{
+		transport: t,
+		name:      name,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[name] = l
+	return l, 0, nil
+}
+
+// Resolve implements Transport interface
+func (t *PipeTransport) Resolve(ctx context.Context, name string, opts NodeOptions) (string, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, exists := t.listeners[name]; !exists {
+		return "", fmt.Errorf("Can't resolve node %s", name)
+	}
+	return name, nil
+}
+
+// Dial implements Transport interface
+func (t *PipeTransport) Dial(ctx context.Context, name string, address string) (net.Conn, error) {
+	t.mtx.Lock()
+	l, exists := t.listeners[address]
+	t.mtx.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("Node %s isn't listening", address)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		err := fmt.Errorf("Node %s isn't listening", address)
+		client.Close()
+		server.Close()
+		return nil, err
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type pipeListener struct {
+	transport *PipeTransport
+	name      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.mtx.Lock()
+		if l.transport.listeners[l.name] == l {
+			delete(l.transport.listeners, l.name)
+		}
+		l.transport.mtx.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
@@ -0,0 +1,47 @@
+package ergonode
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halturin/ergonode/etf"
+)
+
+func TestPipeTransport(t *testing.T) {
+	transport := NewPipeTransport()
+	opts := NodeOptions{Transport: transport, CallTimeout: 2}
+	node1 := newPipeNode(t, "pipe1@localhost", "cookie", opts)
+	defer node1.Stop(context.Background())
+	node2 := newPipeNode(t, "pipe2@localhost", "cookie", opts)
+
+	opts.EPMDPort = 1
+	opts.DisableEPMDServer = true
+	if _, err := Create("pipe2@localhost", "cookie", opts); err == nil {
+		t.Fatal("node with duplicate name has been created")
+	}
+
+	gs1 := new(testEchoServer)
+	node1.Spawn(gs1)
+	gs2 := new(testEchoServer)
+	pid2 := node2.Spawn(gs2)
+
+	message := etf.Term(etf.Atom("hello"))
+	reply, err := gs1.Call(pid2, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reply != message {
+		t.Fatalf("expected %#v, got %#v", message, *reply)
+	}
+	if nodes := node1.Nodes(); len(nodes) != 1 || nodes[0] != "pipe2@localhost" {
+		t.Fatalf("wrong list of the connected nodes %v", nodes)
+	}
+
+	node2.Stop(context.Background())
+	if _, err := gs1.Call(pid2, &message); err == nil {
+		t.Fatal("call to the stopped node has succeeded")
+	}
+	if _, err := transport.Resolve(context.Background(), "pipe2@localhost", opts); err == nil {
+		t.Fatal("stopped node is still resolvable")
+	}
+}